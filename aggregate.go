@@ -0,0 +1,109 @@
+package spotlog
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// repeats returns true if other repeats the entry: it is logged by the same
+// logger with the same level, message format and field keys, within window of
+// the first time the entry was logged. A zero window is unlimited.
+func (s *storedEntry) repeats(other *storedEntry, window time.Duration) bool {
+	if s.origin != other.origin || s.level != other.level || s.method != other.method ||
+		s.always != other.always || len(s.data) != len(other.data) {
+		return false
+	}
+	if window > 0 && other.time.Sub(s.time) > window {
+		return false
+	}
+	if s.method == printLogf {
+		if s.format != other.format {
+			return false
+		}
+	} else if !argsEqual(s.args, other.args) {
+		return false
+	}
+	for k := range s.data {
+		if _, ok := other.data[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// argsEqual returns true if the arguments are equal. Arguments which are not
+// comparable are never equal.
+func argsEqual(a, b []interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !valueEqual(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// valueEqual returns true if the values are equal. A comparable type may still
+// hold an uncomparable value in an interface field, then comparing panics and
+// the values are not equal.
+func valueEqual(a, b interface{}) (equal bool) {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if reflect.TypeOf(a) != reflect.TypeOf(b) || !reflect.TypeOf(a).Comparable() {
+		return false
+	}
+	defer func() {
+		if recover() != nil {
+			equal = false
+		}
+	}()
+	return a == b
+}
+
+// collapse counts other as a repeat of the entry.
+func (s *storedEntry) collapse(other *storedEntry) {
+	s.repeated = s.count() + other.count()
+	if last := other.lastTime(); last.After(s.lastTime()) {
+		s.last = last
+	}
+}
+
+// count returns the count of log calls collapsed into the entry.
+func (s *storedEntry) count() int {
+	if s.repeated == 0 {
+		return 1
+	}
+	return s.repeated
+}
+
+// lastTime returns the time of the last log call collapsed into the entry.
+func (s *storedEntry) lastTime() time.Time {
+	if s.last.IsZero() {
+		return s.time
+	}
+	return s.last
+}
+
+// timestampFormat returns the timestamp format of the formatter, so the first
+// and last times of a collapsed entry are output like its timestamp.
+func timestampFormat(formatter logrus.Formatter) string {
+	format := ""
+	switch f := formatter.(type) {
+	case *logrus.TextFormatter:
+		format = f.TimestampFormat
+	case *logrus.JSONFormatter:
+		format = f.TimestampFormat
+	case hookFormatter:
+		return timestampFormat(f.Formatter)
+	}
+	if format == "" {
+		// The default format of logrus.
+		return time.RFC3339
+	}
+	return format
+}
@@ -0,0 +1,122 @@
+package spotlog_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/13rac1/spotlog"
+	"github.com/sirupsen/logrus"
+)
+
+// benchmarkGoroutines runs b.N calls of fn split over the count of
+// goroutines.
+func benchmarkGoroutines(b *testing.B, goroutines int, fn func()) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		n := b.N / goroutines
+		if g < b.N%goroutines {
+			n++
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				fn()
+			}
+		}()
+	}
+	wg.Wait()
+	b.StopTimer()
+}
+
+// benchmarkLog stores b.N Debug entries from the count of goroutines sharing
+// one logger.
+func benchmarkLog(b *testing.B, goroutines int, opts ...spotlog.Option) {
+	opts = append([]spotlog.Option{
+		spotlog.WithOutput(ioutil.Discard),
+		spotlog.WithMaxEntries(4096),
+	}, opts...)
+	logger := spotlog.New(opts...)
+	benchmarkGoroutines(b, goroutines, func() {
+		logger.Debug("debugmsg")
+	})
+	logger.Discard()
+}
+
+// baselineEntry and baselineLogger are the storage of the first SpotLogger:
+// the arguments of each entry appended to a slice under one mutex.
+type baselineEntry struct {
+	method string
+	level  logrus.Level
+	format string
+	args   []interface{}
+}
+
+type baselineLogger struct {
+	mu      sync.Mutex
+	entries []baselineEntry
+}
+
+func (l *baselineLogger) log(level logrus.Level, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Truncated at the limit of the other runs, reusing the slice.
+	if len(l.entries) == 4096 {
+		l.entries = l.entries[:0]
+	}
+	l.entries = append(l.entries, baselineEntry{"log", level, "", args})
+}
+
+func BenchmarkLog(b *testing.B) {
+	for _, goroutines := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("baseline/%d", goroutines), func(b *testing.B) {
+			logger := &baselineLogger{}
+			benchmarkGoroutines(b, goroutines, func() {
+				logger.log(logrus.DebugLevel, "debugmsg")
+			})
+		})
+		b.Run(fmt.Sprintf("single/%d", goroutines), func(b *testing.B) {
+			benchmarkLog(b, goroutines)
+		})
+		b.Run(fmt.Sprintf("sharded/%d", goroutines), func(b *testing.B) {
+			benchmarkLog(b, goroutines, spotlog.WithShards(runtime.GOMAXPROCS(0)))
+		})
+	}
+}
+
+func BenchmarkCapture(b *testing.B) {
+	type point struct{ X, Y int }
+	p := &point{1, 2}
+	for _, mode := range []spotlog.CaptureMode{spotlog.CaptureLazy, spotlog.CaptureSnapshot} {
+		b.Run(mode.String(), func(b *testing.B) {
+			logger := spotlog.New(
+				spotlog.WithOutput(ioutil.Discard),
+				spotlog.WithCaptureMode(mode),
+			)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				logger.WithField("user", "alice").Debugf("point %v at %d", p, i)
+				// Most entries are discarded at the end of a request.
+				if i%100 == 99 {
+					logger.Discard()
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDiscard(b *testing.B) {
+	logger := spotlog.New(spotlog.WithOutput(ioutil.Discard))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		logger.Debug("debugmsg")
+		logger.WithField("user", "alice").Debug("debugmsg")
+		logger.Discard()
+	}
+}
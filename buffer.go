@@ -0,0 +1,602 @@
+package spotlog
+
+import (
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// budget is a byte limit shared by all buffers in the process.
+type budget struct {
+	// max is the byte limit, zero is unlimited. Accessed atomically.
+	max int64
+	// used is the estimated bytes stored. Accessed atomically.
+	used int64
+}
+
+var globalBudget budget
+
+// SetGlobalMaxBufferBytes limits the estimated bytes stored by all live
+// SpotLoggers together. When the limit is reached, the logger storing a new
+// entry drops its oldest entries. The new entry is kept, so the limit may be
+// exceeded by the newest entry of each logger. Entries stored without a limit
+// are not counted. Defaults to zero, which is unlimited.
+func SetGlobalMaxBufferBytes(n int64) {
+	atomic.StoreInt64(&globalBudget.max, n)
+}
+
+// GlobalBufferBytes returns the estimated bytes stored by all live SpotLoggers.
+// The size of an entry is only estimated if a global limit is set when it is
+// stored, or the logger has a byte limit or spills entries.
+func GlobalBufferBytes() int64 {
+	return atomic.LoadInt64(&globalBudget.used)
+}
+
+func (g *budget) add(n int) {
+	atomic.AddInt64(&g.used, int64(n))
+}
+
+func (g *budget) exceeded() bool {
+	max := atomic.LoadInt64(&g.max)
+	return max > 0 && atomic.LoadInt64(&g.used) > max
+}
+
+// usage is the share of the global budget used by a store, the spill files it
+// created and its reference to an output lock. Stored entries may reference
+// the loggers of the store, so the store can be part of a reference cycle and
+// is not finalized. usage references no logger, so its finalizer runs once the
+// store is unreachable.
+type usage struct {
+	// bytes is the estimated bytes stored. Accessed atomically.
+	bytes int64
+
+	mu    sync.Mutex
+	files map[string]struct{}
+
+	// output is the lock of the base logger of the store.
+	output *outputLock
+}
+
+func newUsage(output *outputLock) *usage {
+	u := &usage{output: output}
+	runtime.SetFinalizer(u, (*usage).release)
+	return u
+}
+
+// add adds n bytes to the usage and the global budget.
+func (u *usage) add(n int) {
+	atomic.AddInt64(&u.bytes, int64(n))
+	globalBudget.add(n)
+}
+
+// reset returns the stored bytes to the global budget.
+func (u *usage) reset() {
+	globalBudget.add(-int(atomic.SwapInt64(&u.bytes, 0)))
+}
+
+// addFile records a spill file, deleted by release if it is still there.
+func (u *usage) addFile(name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.files == nil {
+		u.files = map[string]struct{}{}
+	}
+	u.files[name] = struct{}{}
+}
+
+// removeFile deletes a spill file.
+func (u *usage) removeFile(name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	delete(u.files, name)
+	_ = os.Remove(name)
+}
+
+// release returns the stored bytes to the global budget, deletes the spill
+// files and releases the output lock.
+func (u *usage) release() {
+	u.reset()
+	u.output.release()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for name := range u.files {
+		_ = os.Remove(name)
+	}
+	u.files = nil
+}
+
+// shard is a ring of entries with its own lock, so goroutines storing into
+// different shards of a buffer don't contend.
+type shard struct {
+	mu   sync.Mutex
+	ring []storedEntry
+	// slab holds the ring, so it is reused when the shard is reset.
+	slab *slab
+	// start is the index of the oldest entry in the ring.
+	start int
+	count int
+
+	// dropped is the count of entries evicted since the last reset.
+	dropped int
+	// droppedBytes is the estimated size of the evicted entries.
+	droppedBytes int
+	// droppedFields is the count of field values removed from large entries.
+	droppedFields int
+
+	// pad keeps the shards on separate cache lines.
+	_ [64]byte
+}
+
+// buffer stores the entries of a logger spread over shards. A goroutine
+// usually stores into the shard of the processor it runs on, and the shards
+// are merged by time when the entries are output. When a limit is set, the
+// oldest entries are evicted and counted as dropped.
+type buffer struct {
+	// store holds the limits and the mode shared by the buffers of a tree.
+	store *store
+
+	shards []shard
+	// picks hands out the shards, see pick.
+	picks sync.Pool
+	// picked is the count of shards handed out. Accessed atomically.
+	picked uint32
+
+	// bytes is the total of all shards, changed with the lock of a shard
+	// held. Only kept if the buffer spills. Accessed atomically.
+	bytes int64
+
+	// maxBytes is the byte limit of the store, larger entries lose their
+	// largest fields. Zero is unlimited.
+	maxBytes int
+	// maxAge is the age limit, zero is unlimited.
+	maxAge time.Duration
+	// now returns the current time, to expire entries older than maxAge.
+	now func() time.Time
+
+	// spill moves the oldest entries out of memory, nil if not configured.
+	spill *spill
+
+	// aggregate collapses repeated entries within aggregateWindow.
+	aggregate       bool
+	aggregateWindow time.Duration
+
+	// detached is true if the buffer was removed from the store while it was
+	// empty, see store.reset. Changed with the store and the buffer locked.
+	detached bool
+	// closed stops storing entries in the buffer of a closed child, see
+	// store.discard. Changed with the store and the buffer locked.
+	closed bool
+}
+
+func newBuffer(s *store, shards int) *buffer {
+	c := s.config
+	b := &buffer{
+		store:           s,
+		shards:          make([]shard, shards),
+		maxBytes:        c.maxBytes,
+		maxAge:          c.maxAge,
+		now:             c.now,
+		aggregate:       c.aggregate,
+		aggregateWindow: c.aggregateWindow,
+	}
+	if c.spillTarget != nil {
+		b.spill = &spill{
+			threshold: c.spillThreshold,
+			target:    c.spillTarget(s.usage),
+			store:     s,
+		}
+	}
+	return b
+}
+
+// pick returns the shard to store into, which is returned with put. The
+// shards are handed out by a sync.Pool, which keeps a cache per processor, so
+// goroutines running on different processors usually store into different
+// shards without sharing a counter.
+func (b *buffer) pick() *shard {
+	if len(b.shards) == 1 {
+		return &b.shards[0]
+	}
+	if sh, ok := b.picks.Get().(*shard); ok {
+		return sh
+	}
+	i := atomic.AddUint32(&b.picked, 1) - 1
+	return &b.shards[i%uint32(len(b.shards))]
+}
+
+// put returns a shard returned by pick.
+func (b *buffer) put(sh *shard) {
+	if len(b.shards) > 1 {
+		b.picks.Put(sh)
+	}
+}
+
+// push adds an entry, evicting the oldest entries of the store if a limit is
+// reached, and the entries older than maxAge. Returns false without storing
+// the entry if the store passes entries through. A closed store drops the
+// entry.
+func (b *buffer) push(entry storedEntry) bool {
+	removed := 0
+	if b.sized() {
+		entry.size = entry.estimateSize()
+		if b.maxBytes > 0 && entry.size > b.maxBytes {
+			entry, removed = entry.withoutLargeFields(b.maxBytes)
+		}
+	}
+
+	var seq uint64
+	for {
+		sh := b.pick()
+		result, added := b.insert(sh, entry, removed)
+		b.put(sh)
+		switch result {
+		case insertPassthrough:
+			return false
+		case insertDetached:
+			b.store.attach(b)
+			continue
+		}
+		seq = added
+		break
+	}
+
+	if seq != 0 {
+		b.spillOver()
+		b.store.evict(seq)
+	}
+	return true
+}
+
+// Results of buffer.insert.
+const (
+	insertStored = iota
+	insertPassthrough
+	insertDetached
+)
+
+// insert adds the entry to the shard, see push. Returns insertDetached
+// without storing the entry if the buffer must be attached to the store
+// first. Returns the sequence number of the entry if it was added, or zero if
+// it was dropped or collapsed into an earlier entry.
+func (b *buffer) insert(sh *shard, entry storedEntry, removed int) (int, uint64) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	// The mode only stops storing with the locks of all shards held, so no
+	// entry is stored after a flush has started.
+	switch atomic.LoadInt32(&b.store.mode) {
+	case modePassthrough:
+		return insertPassthrough, 0
+	case modeClosed:
+		return insertStored, 0
+	}
+	if b.closed {
+		return insertStored, 0
+	}
+	if b.detached {
+		return insertDetached, 0
+	}
+	if b.maxAge > 0 {
+		b.expireShard(sh, b.now())
+	}
+	sh.droppedFields += removed
+	if b.aggregate && sh.count > 0 {
+		newest := &sh.ring[(sh.start+sh.count-1)%len(sh.ring)]
+		if newest.repeats(&entry, b.aggregateWindow) {
+			newest.collapse(&entry)
+			return insertStored, 0
+		}
+	}
+	if sh.count == len(sh.ring) {
+		sh.grow()
+	}
+	entry.seq = atomic.AddUint64(&b.store.seq, 1)
+	sh.ring[(sh.start+sh.count)%len(sh.ring)] = entry
+	sh.count++
+	b.add(1, entry.size)
+	return insertStored, entry.seq
+}
+
+// sized returns true if the size of the entries is needed for a byte limit,
+// the global budget or a spill. The size of other entries is not estimated,
+// because it walks their arguments and fields.
+func (b *buffer) sized() bool {
+	return b.maxBytes > 0 || b.spill != nil || atomic.LoadInt64(&globalBudget.max) > 0
+}
+
+// add adds n entries of size bytes to the totals of the buffer and the store.
+// Must be called with the lock of a shard held.
+func (b *buffer) add(n int, size int) {
+	if b.store.limited() {
+		atomic.AddInt64(&b.store.count, int64(n))
+	}
+	if size == 0 {
+		return
+	}
+	if b.spill != nil {
+		atomic.AddInt64(&b.bytes, int64(size))
+	}
+	b.store.usage.add(size)
+}
+
+// removeOldest removes the oldest entry of the buffer, counting it as dropped
+// if drop is true. Returns false if the buffer is empty.
+func (b *buffer) removeOldest(drop bool) (storedEntry, bool) {
+	if len(b.shards) == 1 {
+		sh := &b.shards[0]
+		sh.mu.Lock()
+		defer sh.mu.Unlock()
+
+		if sh.count == 0 {
+			return storedEntry{}, false
+		}
+		return b.removeHead(sh, drop), true
+	}
+
+	for {
+		sh, seq, _ := b.oldest()
+		if sh == nil {
+			return storedEntry{}, false
+		}
+
+		sh.mu.Lock()
+		// The entry may have been removed by another goroutine, then the
+		// shards are searched again.
+		var entry storedEntry
+		found := sh.count > 0 && sh.ring[sh.start].seq == seq
+		if found {
+			entry = b.removeHead(sh, drop)
+		}
+		sh.mu.Unlock()
+		if found {
+			return entry, true
+		}
+	}
+}
+
+// removeHead removes the oldest entry of the shard, counting it as dropped if
+// drop is true. Must be called with sh.mu held.
+func (b *buffer) removeHead(sh *shard, drop bool) storedEntry {
+	if drop {
+		b.evict(sh)
+		return storedEntry{}
+	}
+	return b.remove(sh)
+}
+
+// oldest returns the shard holding the oldest entry, and the sequence number
+// in the shard and time of the entry. Returns nil if the buffer is empty.
+func (b *buffer) oldest() (*shard, uint64, time.Time) {
+	var oldest *shard
+	var seq uint64
+	var t time.Time
+	for i := range b.shards {
+		sh := &b.shards[i]
+		sh.mu.Lock()
+		if sh.count > 0 && (oldest == nil || sh.ring[sh.start].time.Before(t)) {
+			oldest = sh
+			seq = sh.ring[sh.start].seq
+			t = sh.ring[sh.start].time
+		}
+		sh.mu.Unlock()
+	}
+	return oldest, seq, t
+}
+
+// expire evicts the entries older than maxAge at now from all shards.
+func (b *buffer) expire(now time.Time) {
+	for i := range b.shards {
+		sh := &b.shards[i]
+		sh.mu.Lock()
+		b.expireShard(sh, now)
+		sh.mu.Unlock()
+	}
+}
+
+// expireShard evicts the entries older than maxAge at now from the shard.
+// Must be called with sh.mu held.
+func (b *buffer) expireShard(sh *shard, now time.Time) {
+	if b.maxAge <= 0 {
+		return
+	}
+	cutoff := now.Add(-b.maxAge)
+	for sh.count > 0 && sh.ring[sh.start].time.Before(cutoff) {
+		b.evict(sh)
+	}
+}
+
+// lock stops entries from being stored or spilled into the buffer.
+func (b *buffer) lock() {
+	if b.spill != nil {
+		b.spill.mu.Lock()
+	}
+	for i := range b.shards {
+		b.shards[i].mu.Lock()
+	}
+}
+
+func (b *buffer) unlock() {
+	for i := range b.shards {
+		b.shards[i].mu.Unlock()
+	}
+	if b.spill != nil {
+		b.spill.mu.Unlock()
+	}
+}
+
+// grow doubles the ring capacity.
+func (sh *shard) grow() {
+	size := len(sh.ring) * 2
+	if size == 0 {
+		size = minSlabSize
+	}
+	s := getSlab(size)
+	ring := *s
+	for i := 0; i < sh.count; i++ {
+		ring[i] = sh.ring[(sh.start+i)%len(sh.ring)]
+	}
+	sh.release()
+	sh.ring = ring
+	sh.slab = s
+	sh.start = 0
+}
+
+// release clears the stored entries, so they can be garbage collected, and
+// returns the ring to the slab pool. Must be called with sh.mu held or no
+// entries being stored.
+func (sh *shard) release() {
+	if sh.slab == nil {
+		return
+	}
+	for i := 0; i < sh.count; i++ {
+		sh.ring[(sh.start+i)%len(sh.ring)] = storedEntry{}
+	}
+	putSlab(sh.slab)
+	sh.ring = nil
+	sh.slab = nil
+}
+
+// slab is a ring of empty entries, reused across buffers. Entries are stored
+// by value, so the pooled slabs also pool the stored entries.
+type slab []storedEntry
+
+const (
+	// minSlabSize is the size of the first ring of a shard, rings grow by
+	// doubling.
+	minSlabSize = 8
+	// slabClasses is the count of pooled slab sizes, up to 32768 entries.
+	// Larger slabs are left to the garbage collector.
+	slabClasses = 13
+)
+
+// slabPools holds the slabs of each size.
+var slabPools [slabClasses]sync.Pool
+
+// getSlab returns an empty slab of size entries, where size is minSlabSize
+// times a power of two.
+func getSlab(size int) *slab {
+	if class := slabClass(size); class < slabClasses {
+		if s, ok := slabPools[class].Get().(*slab); ok {
+			return s
+		}
+	}
+	s := make(slab, size)
+	return &s
+}
+
+// putSlab returns an empty slab to the pool.
+func putSlab(s *slab) {
+	if class := slabClass(len(*s)); class < slabClasses {
+		slabPools[class].Put(s)
+	}
+}
+
+// slabClass returns the pool index of a slab size.
+func slabClass(size int) int {
+	class := 0
+	for size > minSlabSize {
+		size /= 2
+		class++
+	}
+	return class
+}
+
+// evict removes the oldest entry of the shard and counts it as dropped. Must
+// be called with sh.mu held.
+func (b *buffer) evict(sh *shard) {
+	entry := b.remove(sh)
+	sh.dropped++
+	sh.droppedBytes += entry.size
+}
+
+// remove removes the oldest entry of the shard. Must be called with sh.mu
+// held.
+func (b *buffer) remove(sh *shard) storedEntry {
+	entry := sh.ring[sh.start]
+	sh.ring[sh.start] = storedEntry{}
+	sh.start = (sh.start + 1) % len(sh.ring)
+	sh.count--
+	b.add(-1, -entry.size)
+	return entry
+}
+
+// entries returns the stored entries from oldest to newest. Must be called
+// with the buffer locked.
+func (b *buffer) entries() []storedEntry {
+	n := 0
+	for i := range b.shards {
+		n += b.shards[i].count
+	}
+	entries := make([]storedEntry, 0, n)
+	for i := range b.shards {
+		sh := &b.shards[i]
+		for j := 0; j < sh.count; j++ {
+			entries = append(entries, sh.ring[(sh.start+j)%len(sh.ring)])
+		}
+	}
+	if len(b.shards) > 1 {
+		// Each shard is in order, entries of different shards are ordered
+		// by time, then by the order they were stored.
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].before(&entries[j])
+		})
+	}
+	return entries
+}
+
+// addDrops adds the dropped counts of the buffer to d. Must be called with the
+// buffer locked.
+func (b *buffer) addDrops(d *drops) {
+	for i := range b.shards {
+		sh := &b.shards[i]
+		d.entries += sh.dropped
+		d.bytes += sh.droppedBytes
+		d.fields += sh.droppedFields
+		if sh.count > 0 {
+			if t := sh.ring[sh.start].time; d.oldest.IsZero() || t.Before(d.oldest) {
+				d.oldest = t
+			}
+		}
+	}
+	if b.spill != nil {
+		b.spill.addDrops(d)
+	}
+}
+
+// reset removes all entries and the dropped counts. Returns the count and
+// estimated bytes of the removed entries, the caller updates the totals of
+// the store. Must be called with the buffer locked.
+func (b *buffer) reset() (count int, bytes int) {
+	atomic.StoreInt64(&b.bytes, 0)
+	for i := range b.shards {
+		sh := &b.shards[i]
+		for j := 0; j < sh.count; j++ {
+			bytes += sh.ring[(sh.start+j)%len(sh.ring)].size
+		}
+		count += sh.count
+		sh.reset()
+	}
+	if b.spill != nil {
+		spilled, spilledBytes := b.spill.reset()
+		count += spilled
+		bytes += spilledBytes
+	}
+	return count, bytes
+}
+
+// reset removes all entries and the dropped counts of the shard. Must be
+// called with sh.mu held.
+func (sh *shard) reset() {
+	sh.release()
+	sh.start = 0
+	sh.count = 0
+	sh.dropped = 0
+	sh.droppedBytes = 0
+	sh.droppedFields = 0
+}
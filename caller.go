@@ -0,0 +1,62 @@
+package spotlog
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	maximumCallerDepth = 25
+	logrusPackage      = "github.com/sirupsen/logrus"
+)
+
+var (
+	// qualified package name, cached at first use
+	spotlogPackage string
+
+	// Used for caller information initialisation
+	callerInitOnce sync.Once
+)
+
+// getPackageName reduces a fully qualified function name to the package name.
+func getPackageName(f string) string {
+	for {
+		lastPeriod := strings.LastIndex(f, ".")
+		lastSlash := strings.LastIndex(f, "/")
+		if lastPeriod > lastSlash {
+			f = f[:lastPeriod]
+		} else {
+			break
+		}
+	}
+
+	return f
+}
+
+// getCaller retrieves the first calling function outside of spotlog and logrus.
+func getCaller() *runtime.Frame {
+	callerInitOnce.Do(func() {
+		pc, _, _, _ := runtime.Caller(0)
+		spotlogPackage = getPackageName(runtime.FuncForPC(pc).Name())
+	})
+
+	// Restrict the lookback frames to avoid runaway lookups
+	pcs := make([]uintptr, maximumCallerDepth)
+	depth := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:depth])
+
+	for {
+		f, more := frames.Next()
+		pkg := getPackageName(f.Function)
+		if pkg != spotlogPackage && pkg != logrusPackage {
+			return &f
+		}
+		if !more {
+			break
+		}
+	}
+
+	// The caller was not found.
+	return nil
+}
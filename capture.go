@@ -0,0 +1,68 @@
+package spotlog
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CaptureMode is how the arguments of an entry are captured when it is
+// stored.
+type CaptureMode int
+
+const (
+	// CaptureLazy keeps the arguments and fields until the entry is output, so
+	// a discarded entry costs almost nothing. A value changed after the log
+	// call is output in its later state.
+	CaptureLazy CaptureMode = iota
+	// CaptureSnapshot renders the message and copies the fields when the
+	// entry is logged, so the arguments are output as they were and can be
+	// garbage collected. Field values other than scalars, times and errors,
+	// such as pointers and structs, are rendered with fmt.Sprint the same as
+	// logrus.TextFormatter does.
+	CaptureSnapshot
+)
+
+func (m CaptureMode) String() string {
+	switch m {
+	case CaptureLazy:
+		return "lazy"
+	case CaptureSnapshot:
+		return "snapshot"
+	}
+	return "unknown"
+}
+
+// snapshot renders the message of the entry and copies its fields.
+func (s *storedEntry) snapshot() {
+	s.args = []interface{}{s.message()}
+	s.method = printLog
+	s.format = ""
+
+	if s.data != nil {
+		data := make(logrus.Fields, len(s.data))
+		for k, v := range s.data {
+			data[k] = snapshotValue(v)
+		}
+		s.data = data
+	}
+}
+
+// snapshotValue returns v if it can not change after the log call, or v
+// rendered to a string. Errors are kept for the hooks inspecting them.
+func snapshotValue(v interface{}) interface{} {
+	switch v.(type) {
+	case nil, string, bool, time.Time, error:
+		return v
+	}
+	switch reflect.TypeOf(v).Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return v
+	}
+	return fmt.Sprint(v)
+}
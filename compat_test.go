@@ -0,0 +1,123 @@
+package spotlog_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/13rac1/spotlog"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// printer is implemented by logrus.Logger, logrus.Entry, spotlog.SpotLogger
+// and spotlog.Entry.
+type printer interface {
+	Log(level logrus.Level, args ...interface{})
+	Trace(args ...interface{})
+	Debug(args ...interface{})
+	Info(args ...interface{})
+	Print(args ...interface{})
+	Warn(args ...interface{})
+	Warning(args ...interface{})
+	Error(args ...interface{})
+
+	Logf(level logrus.Level, format string, args ...interface{})
+	Tracef(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Printf(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+
+	Logln(level logrus.Level, args ...interface{})
+	Traceln(args ...interface{})
+	Debugln(args ...interface{})
+	Infoln(args ...interface{})
+	Println(args ...interface{})
+	Warnln(args ...interface{})
+	Warningln(args ...interface{})
+	Errorln(args ...interface{})
+}
+
+var compatTests = []struct {
+	name string
+	call func(p printer)
+}{
+	{"Log", func(p printer) { p.Log(logrus.DebugLevel, "a", 1, 2, "b") }},
+	{"Trace", func(p printer) { p.Trace("a", 1, 2, "b") }},
+	{"Debug", func(p printer) { p.Debug("a", 1, 2, "b") }},
+	{"Info", func(p printer) { p.Info("a", 1, 2, "b") }},
+	{"Print", func(p printer) { p.Print("a", 1, 2, "b") }},
+	{"Warn", func(p printer) { p.Warn("a", 1, 2, "b") }},
+	{"Warning", func(p printer) { p.Warning("a", 1, 2, "b") }},
+	{"Error", func(p printer) { p.Error("a", 1, 2, "b") }},
+
+	{"Logf", func(p printer) { p.Logf(logrus.DebugLevel, "x=%d y=%s", 1, "b") }},
+	{"Tracef", func(p printer) { p.Tracef("x=%d y=%s", 1, "b") }},
+	{"Debugf", func(p printer) { p.Debugf("x=%d y=%s", 1, "b") }},
+	{"Infof", func(p printer) { p.Infof("x=%d y=%s", 1, "b") }},
+	{"Printf", func(p printer) { p.Printf("x=%d y=%s", 1, "b") }},
+	{"Warnf", func(p printer) { p.Warnf("x=%d y=%s", 1, "b") }},
+	{"Warningf", func(p printer) { p.Warningf("x=%d y=%s", 1, "b") }},
+	{"Errorf", func(p printer) { p.Errorf("x=%d y=%s", 1, "b") }},
+
+	{"Logln", func(p printer) { p.Logln(logrus.DebugLevel, "a", 1, 2, "b") }},
+	{"Traceln", func(p printer) { p.Traceln("a", 1, 2, "b") }},
+	{"Debugln", func(p printer) { p.Debugln("a", 1, 2, "b") }},
+	{"Infoln", func(p printer) { p.Infoln("a", 1, 2, "b") }},
+	{"Println", func(p printer) { p.Println("a", 1, 2, "b") }},
+	{"Warnln", func(p printer) { p.Warnln("a", 1, 2, "b") }},
+	{"Warningln", func(p printer) { p.Warningln("a", 1, 2, "b") }},
+	{"Errorln", func(p printer) { p.Errorln("a", 1, 2, "b") }},
+}
+
+func newCompatLoggers(t *testing.T) (*bytes.Buffer, *logrus.Logger, *bytes.Buffer, *spotlog.SpotLogger) {
+	t.Helper()
+	formatter := &logrus.TextFormatter{DisableTimestamp: true}
+
+	var expected bytes.Buffer
+	logrusLogger := logrus.New()
+	logrusLogger.Out = &expected
+	logrusLogger.Formatter = formatter
+	logrusLogger.Level = logrus.TraceLevel
+
+	var actual bytes.Buffer
+	spotLogger := spotlog.New(
+		spotlog.WithOutput(&actual),
+		spotlog.WithFormatter(formatter),
+	)
+	return &expected, logrusLogger, &actual, spotLogger
+}
+
+func TestCompatLogger(t *testing.T) {
+	for _, test := range compatTests {
+		t.Run(test.name, func(t *testing.T) {
+			expected, logrusLogger, actual, spotLogger := newCompatLoggers(t)
+
+			test.call(logrusLogger)
+			logrusLogger.Error("flush")
+
+			test.call(spotLogger)
+			spotLogger.Error("flush")
+
+			assert.Equal(t, expected.String(), actual.String())
+		})
+	}
+}
+
+func TestCompatEntry(t *testing.T) {
+	for _, test := range compatTests {
+		t.Run(test.name, func(t *testing.T) {
+			expected, logrusLogger, actual, spotLogger := newCompatLoggers(t)
+
+			test.call(logrusLogger.WithField("key", "value"))
+			logrusLogger.Error("flush")
+
+			test.call(spotLogger.WithField("key", "value"))
+			spotLogger.Error("flush")
+
+			assert.Equal(t, expected.String(), actual.String())
+		})
+	}
+}
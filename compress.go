@@ -0,0 +1,173 @@
+package spotlog
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+// compressSegmentSize is the size of the encoded entries collected in a
+// segment before it is sealed and compressed.
+const compressSegmentSize = 32 << 10
+
+// flateWriters reuses the flate writers sealing segments.
+var flateWriters sync.Pool
+
+// compressedTarget keeps the spilled entries in memory, compressing each
+// segment when it is full.
+type compressedTarget struct {
+	sealed []compressedSegment
+	open   bytes.Buffer
+
+	// raw and compressed are the sizes of the sealed segments before and
+	// after compression.
+	raw        int
+	compressed int
+}
+
+// compressedSegment is a sealed segment and its size before compression.
+type compressedSegment struct {
+	data []byte
+	raw  int
+}
+
+func (t *compressedTarget) Write(p []byte) (int, error) {
+	return t.open.Write(p)
+}
+
+func (t *compressedTarget) full() bool {
+	return t.open.Len() >= compressSegmentSize
+}
+
+// seal compresses the open segment.
+func (t *compressedTarget) seal() error {
+	if t.open.Len() == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	w, ok := flateWriters.Get().(*flate.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		var err error
+		if w, err = flate.NewWriter(&buf, flate.DefaultCompression); err != nil {
+			return err
+		}
+	}
+	defer flateWriters.Put(w)
+
+	if _, err := w.Write(t.open.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	t.sealed = append(t.sealed, compressedSegment{data: buf.Bytes(), raw: t.open.Len()})
+	t.raw += t.open.Len()
+	t.compressed += buf.Len()
+	t.open.Reset()
+	return nil
+}
+
+func (t *compressedTarget) dropOldest() {
+	if len(t.sealed) == 0 {
+		return
+	}
+	t.raw -= t.sealed[0].raw
+	t.compressed -= len(t.sealed[0].data)
+	t.sealed[0] = compressedSegment{}
+	t.sealed = t.sealed[1:]
+}
+
+func (t *compressedTarget) size() int {
+	return t.compressed + t.open.Len()
+}
+
+// reader decompresses the sealed segments one at a time, followed by the
+// open segment.
+func (t *compressedTarget) reader() (io.Reader, error) {
+	return &segmentReader{sealed: t.sealed, open: t.open.Bytes()}, nil
+}
+
+func (t *compressedTarget) reset() {
+	*t = compressedTarget{}
+}
+
+// segmentReader reads the segments of a compressedTarget in order.
+type segmentReader struct {
+	sealed []compressedSegment
+	open   []byte
+	// current is the reader of the segment being read.
+	current io.Reader
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			switch {
+			case len(r.sealed) > 0:
+				r.current = flate.NewReader(bytes.NewReader(r.sealed[0].data))
+				r.sealed = r.sealed[1:]
+			case r.open != nil:
+				r.current = bytes.NewReader(r.open)
+				r.open = nil
+			default:
+				return 0, io.EOF
+			}
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// CompressionStats describes the entries kept compressed by WithCompression.
+type CompressionStats struct {
+	// Entries is the count of entries kept compressed.
+	Entries int
+	// Segments is the count of sealed segments.
+	Segments int
+	// RawBytes is the size of the encoded entries.
+	RawBytes int
+	// CompressedBytes is the size of the sealed segments, plus the open
+	// segment which is not compressed yet.
+	CompressedBytes int
+}
+
+// Ratio returns RawBytes divided by CompressedBytes, zero if there are no
+// entries.
+func (s CompressionStats) Ratio() float64 {
+	if s.CompressedBytes == 0 {
+		return 0
+	}
+	return float64(s.RawBytes) / float64(s.CompressedBytes)
+}
+
+// CompressionStats returns the statistics of the entries kept compressed by
+// the logger and the other loggers of its tree.
+func (l *SpotLogger) CompressionStats() CompressionStats {
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+
+	var stats CompressionStats
+	for _, b := range l.store.buffers {
+		if b.spill == nil {
+			continue
+		}
+		b.spill.mu.Lock()
+		if t, ok := b.spill.target.(*compressedTarget); ok {
+			stats.Entries += b.spill.count
+			stats.Segments += len(t.sealed)
+			stats.RawBytes += t.raw + t.open.Len()
+			stats.CompressedBytes += t.compressed + t.open.Len()
+		}
+		b.spill.mu.Unlock()
+	}
+	return stats
+}
@@ -2,7 +2,7 @@ package spotlog
 
 import (
 	"context"
-	"fmt"
+	"reflect"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -11,6 +11,9 @@ import (
 type Entry struct {
 	*logrus.Entry
 	Logger *SpotLogger
+
+	// always prints the entry immediately, see Always.
+	always bool
 }
 
 func NewEntry(logger *SpotLogger) *Entry {
@@ -31,51 +34,81 @@ func (e *Entry) WithContext(ctx context.Context) *Entry {
 	for k, v := range e.Data {
 		dataCopy[k] = v
 	}
-	return &Entry{Logger: e.Logger, Entry: e.Entry.WithContext(ctx)}
+	return &Entry{Logger: e.Logger, Entry: e.Entry.WithContext(ctx), always: e.always}
 }
 
 // Add a single field to the Entry.
 func (e *Entry) WithField(key string, value interface{}) *Entry {
-	return e.WithFields(logrus.Fields{key: value})
+	data := make(logrus.Fields, len(e.Data)+1)
+	for k, v := range e.Data {
+		data[k] = v
+	}
+	addField(data, key, value)
+	return e.withData(data)
 }
 
 // Add a map of fields to the Entry.
 func (e *Entry) WithFields(fields logrus.Fields) *Entry {
-	return &Entry{Logger: e.Logger, Entry: e.Entry.WithFields(fields)}
+	data := make(logrus.Fields, len(e.Data)+len(fields))
+	for k, v := range e.Data {
+		data[k] = v
+	}
+	for k, v := range fields {
+		addField(data, k, v)
+	}
+	return e.withData(data)
+}
+
+// addField adds a field to data. Functions are skipped like logrus does, as
+// they can not be formatted.
+func addField(data logrus.Fields, key string, value interface{}) {
+	if t := reflect.TypeOf(value); t != nil {
+		if t.Kind() == reflect.Func || t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Func {
+			return
+		}
+	}
+	data[key] = value
+}
+
+// entryPair holds an Entry and its logrus.Entry, so they are allocated once.
+type entryPair struct {
+	entry  Entry
+	logrus logrus.Entry
+}
+
+// withData returns a copy of the Entry with the data.
+func (e *Entry) withData(data logrus.Fields) *Entry {
+	pair := &entryPair{
+		entry: Entry{Logger: e.Logger, always: e.always},
+		logrus: logrus.Entry{
+			Logger:  e.Entry.Logger,
+			Data:    data,
+			Time:    e.Time,
+			Context: e.Context,
+		},
+	}
+	pair.entry.Entry = &pair.logrus
+	return &pair.entry
 }
 
 // Overrides the time of the Entry.
 func (e *Entry) WithTime(t time.Time) *Entry {
-	return &Entry{Logger: e.Logger, Entry: e.Entry.WithTime(t)}
+	return &Entry{Logger: e.Logger, Entry: e.Entry.WithTime(t), always: e.always}
+}
+
+// Always prints the Entry immediately without printing the stored entries.
+// The Entry is also stored, so it is printed in order by a later flush.
+func (e *Entry) Always() *Entry {
+	return &Entry{Logger: e.Logger, Entry: e.Entry, always: true}
 }
 
 // Original comment from logrus: This function is not declared with a pointer
 // value because otherwise race conditions will occur when using multiple
 // goroutines.
 func (e Entry) log(method printType, level logrus.Level, format string, args ...interface{}) {
-	e.Logger.entriesLock.Lock()
-	defer e.Logger.entriesLock.Unlock()
-
-	if e.Logger.alwaysLog(level) {
-		// Found an important log, print the stored log entries.
-		for _, entry := range e.Logger.entries {
-			switch method {
-			case printLog:
-				e.Entry.Log(entry.level, entry.args...)
-			case printLogf:
-				e.Entry.Logf(entry.level, entry.format, entry.args...)
-			case printLogln:
-				e.Entry.Logln(entry.level, entry.args...)
-			}
-		}
-
-		// Clear the list of output entries.
-		e.Logger.entries = nil
-		// Then print the actual "important" log.
-		e.Entry.Log(level, args...)
-	} else {
-		e.Logger.entries = append(e.Logger.entries, storedEntry{method, level, format, args})
-	}
+	stored := e.Logger.newStoredEntry(method, level, format, args, e.Data, e.Time, e.Context)
+	stored.always = e.always
+	e.Logger.logStored(stored)
 }
 
 func (e *Entry) Log(level logrus.Level, args ...interface{}) {
@@ -117,13 +150,12 @@ func (e *Entry) Fatal(args ...interface{}) {
 
 func (e *Entry) Panic(args ...interface{}) {
 	e.Log(logrus.PanicLevel, args...)
-	panic(fmt.Sprint(args...))
 }
 
 // Entry Printf family functions
 
 func (e *Entry) Logf(level logrus.Level, format string, args ...interface{}) {
-	e.log(printLogf, level, "", args...)
+	e.log(printLogf, level, format, args...)
 }
 
 func (e *Entry) Tracef(format string, args ...interface{}) {
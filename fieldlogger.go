@@ -0,0 +1,92 @@
+package spotlog
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The views returned by FieldLogger implement the logrus interfaces, so they
+// can be passed to libraries expecting a logrus logger.
+var (
+	_ logrus.StdLogger       = fieldLogger{}
+	_ logrus.FieldLogger     = fieldLogger{}
+	_ logrus.Ext1FieldLogger = fieldLogger{}
+)
+
+// fieldLogger is a view of a SpotLogger returning *logrus.Entry values. The
+// entries are logged by a logrus.Logger passing every entry to the SpotLogger.
+type fieldLogger struct {
+	*SpotLogger
+	view *logrus.Logger
+}
+
+// FieldLogger returns a view of the logger implementing logrus.FieldLogger and
+// logrus.Ext1FieldLogger. Entries logged through the view are stored and
+// output by the SpotLogger.
+func (l *SpotLogger) FieldLogger() logrus.Ext1FieldLogger {
+	hooks := make(logrus.LevelHooks)
+	hooks.Add(viewHook{l})
+
+	return fieldLogger{
+		SpotLogger: l,
+		view: &logrus.Logger{
+			Out:          ioutil.Discard,
+			Hooks:        hooks,
+			Formatter:    discardFormatter{},
+			ReportCaller: l.ReportCaller,
+			// Every entry is passed to the SpotLogger.
+			Level: logrus.TraceLevel,
+			ExitFunc: func(code int) {
+				if syncer, ok := l.Out.(interface{ Sync() error }); ok {
+					_ = syncer.Sync()
+				}
+				if l.Logger.ExitFunc == nil {
+					os.Exit(code)
+				}
+				l.Logger.ExitFunc(code)
+			},
+		},
+	}
+}
+
+// WithField allocates a new entry and adds a field to it.
+func (f fieldLogger) WithField(key string, value interface{}) *logrus.Entry {
+	return f.view.WithField(key, value)
+}
+
+// WithFields allocates a new entry and adds the fields to it.
+func (f fieldLogger) WithFields(fields logrus.Fields) *logrus.Entry {
+	return f.view.WithFields(fields)
+}
+
+// WithError allocates a new entry and adds an error field to it.
+func (f fieldLogger) WithError(err error) *logrus.Entry {
+	return f.view.WithError(err)
+}
+
+// viewHook passes every entry of a view to the SpotLogger.
+type viewHook struct {
+	logger *SpotLogger
+}
+
+// Levels returns all levels.
+func (h viewHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire passes the entry to the SpotLogger.
+func (h viewHook) Fire(entry *logrus.Entry) error {
+	h.logger.handleLogrusEntry(entry)
+	return nil
+}
+
+// discardFormatter skips the output of the view, which is output by the
+// SpotLogger instead.
+type discardFormatter struct{}
+
+// Format returns no bytes.
+func (discardFormatter) Format(*logrus.Entry) ([]byte, error) {
+	return nil, nil
+}
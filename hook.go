@@ -0,0 +1,117 @@
+package spotlog
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// Hook passes the entries of an existing logrus.Logger to the SpotLogger
+// stored in the entry context, see Set. Entries are logged with a context
+// using WithContext. The SpotLogger stores or outputs the entry, so the
+// logrus.Logger must use the Formatter returned by NewHookFormatter to skip
+// its own output of the entry. Entries without a SpotLogger in the context are
+// output by the logrus.Logger as usual.
+//
+// Only entries enabled by the level of the logrus.Logger reach the Hook, see
+// InstallHook.
+type Hook struct{}
+
+// InstallHook adds a Hook to the logger and wraps its formatter with
+// NewHookFormatter. The level of the logger is set to logrus.TraceLevel, so
+// every entry reaches the Hook, and entries without a SpotLogger in the
+// context are only output at the original level or higher priority. The other
+// hooks of the logger are removed from the levels below the original level,
+// so they fire for the same entries as before. Hooks added later fire for
+// every entry of their levels.
+//
+// Entries below the original level still pay for the caller lookup of
+// ReportCaller before they are skipped.
+func InstallHook(logger *logrus.Logger) {
+	level := logger.GetLevel()
+	hooks := make(logrus.LevelHooks, len(logger.Hooks))
+	for l, levelHooks := range logger.Hooks {
+		if l <= level {
+			hooks[l] = append([]logrus.Hook(nil), levelHooks...)
+		}
+	}
+	hooks.Add(Hook{})
+	logger.ReplaceHooks(hooks)
+	logger.SetFormatter(hookFormatter{
+		Formatter: logger.Formatter,
+		logger:    logger,
+		level:     level,
+	})
+	logger.SetLevel(logrus.TraceLevel)
+}
+
+// Levels returns all levels.
+func (Hook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire passes the entry to the SpotLogger in the entry context.
+func (Hook) Fire(entry *logrus.Entry) error {
+	logger, ok := hookLogger(entry)
+	if !ok {
+		return nil
+	}
+	logger.handleLogrusEntry(entry)
+	return nil
+}
+
+// handleLogrusEntry stores or outputs an entry logged by logrus.
+func (l *SpotLogger) handleLogrusEntry(entry *logrus.Entry) {
+	data := make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		data[k] = v
+	}
+	l.handle(storedEntry{
+		origin: l,
+		method: printLog,
+		level:  entry.Level,
+		args:   []interface{}{entry.Message},
+		data:   data,
+		time:   entry.Time,
+		ctx:    entry.Context,
+		caller: entry.Caller,
+	})
+}
+
+// hookLogger returns the SpotLogger in the entry context, unless the entry
+// is output by the SpotLogger itself.
+func hookLogger(entry *logrus.Entry) (*SpotLogger, bool) {
+	if entry.Context == nil {
+		return nil, false
+	}
+	logger, ok := fromContext(entry.Context)
+	if !ok || logger.Logger == entry.Logger {
+		return nil, false
+	}
+	return logger, true
+}
+
+// hookFormatter skips the output of entries passed to a SpotLogger by Hook.
+type hookFormatter struct {
+	logrus.Formatter
+	// logger is the logger set up by InstallHook, nil if none. Its entries
+	// without a SpotLogger are skipped below level.
+	logger *logrus.Logger
+	level  logrus.Level
+}
+
+// NewHookFormatter wraps the formatter to skip the output of entries passed
+// to a SpotLogger by Hook.
+func NewHookFormatter(formatter logrus.Formatter) logrus.Formatter {
+	return hookFormatter{Formatter: formatter}
+}
+
+// Format returns no bytes for entries passed to a SpotLogger, otherwise the
+// entry formatted by the wrapped formatter.
+func (f hookFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if _, ok := hookLogger(entry); ok {
+		return nil, nil
+	}
+	if f.logger != nil && entry.Logger == f.logger && entry.Level > f.level {
+		return nil, nil
+	}
+	return f.Formatter.Format(entry)
+}
@@ -2,52 +2,150 @@ package spotlog
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-// New creates a configured SpotLogger.
-func New() *SpotLogger {
-	logrusLogger := logrus.StandardLogger()
-	// The logrus logger is set to TraceLevel to print everything.
-	logrusLogger.Level = logrus.TraceLevel
+// New creates a SpotLogger configured by the passed options.
+func New(opts ...Option) *SpotLogger {
+	c := newConfig(opts)
 
-	return &SpotLogger{
-		Logger:      logrusLogger,
-		entries:     []storedEntry{},
-		minLogLevel: logrus.ErrorLevel,
+	logrusLogger := cloneLogger(c.base)
+	if c.out != nil {
+		logrusLogger.Out = c.out
+	}
+	if c.formatter != nil {
+		logrusLogger.Formatter = c.formatter
+	}
+
+	s := newStore(c)
+	l := &SpotLogger{
+		Logger:        logrusLogger,
+		store:         s,
+		buffer:        s.newBuffer(),
+		triggerLevel:  c.triggerLevel,
+		now:           c.now,
+		capture:       c.capture,
+		trigger:       c.trigger,
+		passthrough:   c.passthrough,
+		passLevel:     c.passLevel,
+		onStateChange: c.onStateChange,
+	}
+	return l
+}
+
+// NewWithLogger creates a SpotLogger using the output, formatter and hooks of
+// the base logger. The base logger is not modified.
+func NewWithLogger(base *logrus.Logger, opts ...Option) *SpotLogger {
+	return New(append([]Option{WithBaseLogger(base)}, opts...)...)
+}
+
+// cloneLogger copies the configuration of the base logger, so the SpotLogger
+// can be changed without changing the base logger.
+func cloneLogger(base *logrus.Logger) *logrus.Logger {
+	hooks := make(logrus.LevelHooks, len(base.Hooks))
+	for level, levelHooks := range base.Hooks {
+		hooks[level] = append([]logrus.Hook(nil), levelHooks...)
+	}
+	return &logrus.Logger{
+		Out:          base.Out,
+		Hooks:        hooks,
+		Formatter:    base.Formatter,
+		ReportCaller: base.ReportCaller,
+		// The logrus logger is set to TraceLevel to print everything.
+		Level:    logrus.TraceLevel,
+		ExitFunc: base.ExitFunc,
 	}
 }
 
 // SpotLogger wraps logrus.Logger to add log storage.
 type SpotLogger struct {
 	*logrus.Logger
-	// minLogLevel is the minimum log level to output.
-	minLogLevel logrus.Level
+	// triggerLevel is the minimum log level to output. Accessed atomically.
+	triggerLevel logrus.Level
+	// trigger replaces triggerLevel when set.
+	trigger Trigger
+	// passthrough prints entries at passLevel or higher priority immediately.
+	passthrough bool
+	passLevel   logrus.Level
+
+	// now returns the current time.
+	now func() time.Time
+	// capture is how the arguments of stored entries are captured.
+	capture CaptureMode
+
+	// onStateChange is called when the window of the store opens or closes.
+	onStateChange func(State)
+
+	// globalFields are added to every entry when it is output.
+	globalFields logrus.Fields
+
+	// store is shared with the children of the logger.
+	store *store
+	// buffer stores the entries of the logger in the store.
+	buffer *buffer
+	// parent is the logger this logger is a child of, see Child.
+	parent *SpotLogger
+
+	// entryPool reuses the entries created by the With methods.
+	entryPool sync.Pool
+}
+
+// Child creates a logger storing entries in the same buffer as l, so a
+// trigger in any logger of the tree outputs the entries of the whole tree in
+// timestamp order. The fields tag the entries of the child, in addition to
+// the global fields of l.
+func (l *SpotLogger) Child(fields logrus.Fields) *SpotLogger {
+	child := &SpotLogger{
+		Logger:        l.Logger,
+		store:         l.store,
+		buffer:        l.store.newBuffer(),
+		triggerLevel:  l.TriggerLevel(),
+		now:           l.now,
+		capture:       l.capture,
+		trigger:       l.trigger,
+		passthrough:   l.passthrough,
+		passLevel:     l.passLevel,
+		onStateChange: l.onStateChange,
+		parent:        l,
+	}
+	return child.WithGlobalFields(fields)
+}
+
+// SetTriggerLevel sets the minimum level which outputs the stored entries.
+func (l *SpotLogger) SetTriggerLevel(level logrus.Level) {
+	atomic.StoreUint32((*uint32)(&l.triggerLevel), uint32(level))
+}
 
-	entries     []storedEntry
-	entriesLock sync.Mutex
+// TriggerLevel returns the minimum level which outputs the stored entries.
+func (l *SpotLogger) TriggerLevel() logrus.Level {
+	return logrus.Level(atomic.LoadUint32((*uint32)(&l.triggerLevel)))
 }
 
 func (l *SpotLogger) alwaysLog(level logrus.Level) bool {
 	// Levels have lower values the higher their priority is.
-	return level <= l.minLogLevel
+	return level <= l.TriggerLevel()
 }
 
 func (l *SpotLogger) newEntry() *Entry {
-	// TODO: Use Pool
-	// entry, ok := l.entryPool.Get().(*Entry)
-	// if ok {
-	// 	return entry
-	// }
+	entry, ok := l.entryPool.Get().(*Entry)
+	if ok {
+		return entry
+	}
 	return NewEntry(l)
 }
 
+// releaseEntry returns an entry created by newEntry to the pool. The With
+// methods of Entry copy the data, so the entry is unchanged and can be reused
+// as it is.
 func (l *SpotLogger) releaseEntry(entry *Entry) {
-	//entry.Data = map[string]interface{}{}
-	//l.entryPool.Put(entry)
+	l.entryPool.Put(entry)
 }
 
 // WithField allocates a new entry and adds a field to it.
@@ -90,30 +188,373 @@ func (l *SpotLogger) WithTime(t time.Time) *Entry {
 	return entry.WithTime(t)
 }
 
+// WithGlobalFields adds fields to every entry output by the logger, including
+// entries stored before the fields were added. Fields of an entry replace
+// global fields with the same key. Returns the logger.
+func (l *SpotLogger) WithGlobalFields(fields logrus.Fields) *SpotLogger {
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+
+	// Copy the fields, so the caller can not change them.
+	globalFields := make(logrus.Fields, len(l.globalFields)+len(fields))
+	for k, v := range l.globalFields {
+		globalFields[k] = v
+	}
+	for k, v := range fields {
+		globalFields[k] = v
+	}
+	l.globalFields = globalFields
+	return l
+}
+
+// GlobalFields returns a copy of the global fields of the logger, including
+// the global fields of its parents.
+func (l *SpotLogger) GlobalFields() logrus.Fields {
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+
+	fields := logrus.Fields{}
+	l.addGlobalFields(fields)
+	return fields
+}
+
+// addGlobalFields adds the global fields of the parents of the logger and
+// then the logger to data. Must be called with store.mu held.
+func (l *SpotLogger) addGlobalFields(data logrus.Fields) {
+	if l.parent != nil {
+		l.parent.addGlobalFields(data)
+	}
+	for k, v := range l.globalFields {
+		data[k] = v
+	}
+}
+
+// Always prints the log entry immediately without printing the stored
+// entries. All it does is call `Always` on a new entry.
+func (l *SpotLogger) Always() *Entry {
+	// The entry is returned as it is, so it must not be a pooled entry.
+	return NewEntry(l).Always()
+}
+
 func (l *SpotLogger) log(method printType, level logrus.Level, format string, args ...interface{}) {
-	l.entriesLock.Lock()
-	defer l.entriesLock.Unlock()
+	l.logStored(l.newStoredEntry(method, level, format, args, nil, time.Time{}, nil))
+}
 
-	if l.alwaysLog(level) {
+// logStored handles the entry, then panics the same as logrus for Panic
+// entries.
+func (l *SpotLogger) logStored(stored storedEntry) {
+	written := l.handle(stored)
+	if stored.level <= logrus.PanicLevel {
+		panic(written)
+	}
+}
+
+// handle stores the entry or, if the entry is important, outputs the stored
+// entries followed by the entry. Returns the output logrus.Entry, if the entry
+// is output by a flush.
+func (l *SpotLogger) handle(stored storedEntry) *logrus.Entry {
+	decision := l.decide(&stored)
+	if decision == DecisionStore && l.buffer.push(stored) {
+		return nil
+	}
+
+	l.store.mu.Lock()
+	now := l.now()
+	l.store.expire(now)
+
+	var changed bool
+	var written *logrus.Entry
+	switch decision {
+	case DecisionFlush:
+		l.store.lockBuffers()
 		// Found an important log, print the stored log entries.
-		for _, entry := range l.entries {
-			switch method {
-			case printLog:
-				l.Logger.Log(entry.level, entry.args...)
-			case printLogf:
-				l.Logger.Logf(entry.level, entry.format, entry.args...)
-			case printLogln:
-				l.Logger.Logln(entry.level, entry.args...)
-			}
+		l.flush()
+		// Then print the actual "important" log entry.
+		written = l.writeEntry(stored)
+		changed = l.store.open(now)
+		l.store.unlockBuffers()
+	default:
+		var pass bool
+		pass, changed = l.store.take(now)
+		if pass {
+			l.writeEntry(stored)
+		} else if decision == DecisionPrint {
+			l.writeEntry(stored)
+			l.buffer.push(stored)
+		} else {
+			l.buffer.push(stored)
 		}
+	}
+	state := l.store.window.state
+	l.store.mu.Unlock()
 
-		// Clear the list of output entries.
-		l.entries = nil
-		// Then print the actual "important" log entry.
-		l.Logger.Log(level, args...)
-	} else {
-		l.entries = append(l.entries, storedEntry{method, level, format, args})
+	// The callback is called without the lock held, so it may log.
+	if changed && l.onStateChange != nil {
+		l.onStateChange(state)
+	}
+	return written
+}
+
+// State returns the storage state of the logger. A window which has passed
+// its duration is closed first.
+func (l *SpotLogger) State() State {
+	l.store.mu.Lock()
+	changed := l.store.expireWindow(l.now())
+	state := l.store.window.state
+	l.store.mu.Unlock()
+
+	if changed && l.onStateChange != nil {
+		l.onStateChange(state)
+	}
+	return state
+}
+
+// flush outputs the stored entries and clears the buffer. Must be called with
+// store.mu held and the buffers locked.
+func (l *SpotLogger) flush() {
+	l.writeDropped()
+	l.store.each(func(stored storedEntry) {
+		l.writeEntry(stored)
+	})
+
+	// Clear the list of output entries.
+	l.store.reset()
+}
+
+// Flush outputs the stored entries and clears the buffer.
+func (l *SpotLogger) Flush() {
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+
+	l.store.expire(l.now())
+	l.store.lockBuffers()
+	defer l.store.unlockBuffers()
+	l.flush()
+}
+
+// Discard clears the buffer without output. Discarding a child only removes
+// the entries of the child, the rest of the tree keeps its entries.
+func (l *SpotLogger) Discard() {
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+
+	if l.parent != nil {
+		l.store.discard(l.buffer, false)
+		return
+	}
+	l.store.lockBuffers()
+	defer l.store.unlockBuffers()
+	l.store.reset()
+}
+
+// Close flushes the stored entries if keep is true, otherwise discards them.
+// A closed logger stores no further entries, only the entries a trigger
+// prints are output. Closing a child only closes the child, see Discard.
+func (l *SpotLogger) Close(keep bool) {
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+
+	if keep {
+		l.store.expire(l.now())
+	}
+	l.store.lockBuffers()
+	if keep {
+		l.flush()
+	} else if l.parent == nil {
+		l.store.reset()
+	}
+	if l.parent == nil {
+		l.store.close()
+	}
+	l.store.unlockBuffers()
+
+	if l.parent != nil {
+		l.store.discard(l.buffer, true)
+	}
+}
+
+// decide returns the action taken for the entry.
+func (l *SpotLogger) decide(stored *storedEntry) Decision {
+	decision := DecisionStore
+	if l.trigger != nil {
+		decision = l.trigger.Decide(Event{
+			Level:   stored.level,
+			Data:    stored.data,
+			Context: stored.ctx,
+			stored:  *stored,
+		})
+	} else if l.alwaysLog(stored.level) {
+		decision = DecisionFlush
+	}
+
+	// Fatal and Panic entries always output the stored entries, because the
+	// program or goroutine is about to stop.
+	if stored.level <= logrus.FatalLevel {
+		return DecisionFlush
+	}
+	if decision == DecisionStore && (stored.always || l.passthrough && stored.level <= l.passLevel) {
+		decision = DecisionPrint
+	}
+	return decision
+}
+
+// writeDropped outputs what was dropped from the buffer, so the reader knows
+// the stored history is incomplete. Must be called with store.mu held and the
+// buffers locked.
+func (l *SpotLogger) writeDropped() {
+	d := l.store.drops()
+	if d.entries == 0 && d.fields == 0 {
+		return
+	}
+	t := d.oldest
+	if t.IsZero() {
+		t = l.now()
+	}
+	data := logrus.Fields{}
+	if d.bytes > 0 && d.limitsBytes {
+		data["dropped_bytes"] = d.bytes
+	}
+	if d.fields > 0 {
+		data["dropped_fields"] = d.fields
+	}
+	l.writeEntry(storedEntry{
+		method: printLogf,
+		level:  logrus.WarnLevel,
+		format: "spotlog: %d earlier entries dropped",
+		args:   []interface{}{d.entries},
+		data:   data,
+		time:   t,
+	})
+}
+
+// newStoredEntry captures a log call with the time and caller of the call.
+func (l *SpotLogger) newStoredEntry(method printType, level logrus.Level, format string, args []interface{},
+	data logrus.Fields, t time.Time, ctx context.Context) storedEntry {
+	if t.IsZero() {
+		t = l.now()
+	}
+	var caller *runtime.Frame
+	if l.ReportCaller {
+		caller = getCaller()
+	}
+	stored := storedEntry{
+		origin: l,
+		method: method,
+		level:  level,
+		format: format,
+		args:   args,
+		data:   data,
+		time:   t,
+		ctx:    ctx,
+		caller: caller,
+	}
+	if l.capture == CaptureSnapshot {
+		stored.snapshot()
+	}
+	return stored
+}
+
+// outputLock serializes the hooks and writes of the loggers cloned from one
+// base logger, which share its output and hooks, the same as logrus does for
+// one logger.
+type outputLock struct {
+	mu   sync.Mutex
+	base *logrus.Logger
+	// refs is the count of stores using the lock, guarded by outputLocksMu.
+	refs int
+}
+
+// outputLocks holds the lock of each base logger used by a live store. A lock
+// is removed when the last store using it is garbage collected.
+var (
+	outputLocksMu sync.Mutex
+	outputLocks   = map[*logrus.Logger]*outputLock{}
+)
+
+// acquireOutputLock returns the lock of the base logger, released by the
+// usage of the store.
+func acquireOutputLock(base *logrus.Logger) *outputLock {
+	outputLocksMu.Lock()
+	defer outputLocksMu.Unlock()
+
+	lock, ok := outputLocks[base]
+	if !ok {
+		lock = &outputLock{base: base}
+		outputLocks[base] = lock
+	}
+	lock.refs++
+	return lock
+}
+
+// release drops a reference to the lock, removing it when it is unused.
+func (o *outputLock) release() {
+	outputLocksMu.Lock()
+	defer outputLocksMu.Unlock()
+
+	o.refs--
+	if o.refs == 0 {
+		delete(outputLocks, o.base)
+	}
+}
+
+// writeEntry renders a stored entry and outputs it through the hooks and
+// formatter of the logrus logger. Returns the output logrus.Entry. Must be
+// called with store.mu held.
+func (l *SpotLogger) writeEntry(stored storedEntry) *logrus.Entry {
+	origin := stored.origin
+	if origin == nil {
+		origin = l
+	}
+	data := make(logrus.Fields, len(origin.globalFields)+len(stored.data))
+	origin.addGlobalFields(data)
+	for k, v := range stored.data {
+		data[k] = v
+	}
+	if stored.repeated > 1 {
+		format := timestampFormat(l.Formatter)
+		data["repeated"] = stored.repeated
+		data["first"] = stored.time.Format(format)
+		data["last"] = stored.lastTime().Format(format)
+	}
+	entry := &logrus.Entry{
+		Logger:  l.Logger,
+		Data:    data,
+		Time:    stored.time,
+		Level:   stored.level,
+		Caller:  stored.caller,
+		Message: stored.message(),
+		Context: stored.ctx,
+	}
+
+	// Loggers cloned from one base share its output, so the lock is shared
+	// by the base instead of using the lock of each logrus logger. The base
+	// logger itself logs holding its own lock, which is not exported.
+	lock := &l.store.usage.output.mu
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := l.Hooks.Fire(entry.Level, entry); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to fire hook: %v\n", err)
+	}
+
+	serialized, err := l.Formatter.Format(entry)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to obtain reader, %v\n", err)
+		return entry
+	}
+	if _, err = l.Out.Write(serialized); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write to log, %v\n", err)
+	}
+	return entry
+}
+
+// Exit syncs the output if possible, then runs the logrus exit handlers and
+// calls ExitFunc.
+func (l *SpotLogger) Exit(code int) {
+	if syncer, ok := l.Out.(interface{ Sync() error }); ok {
+		_ = syncer.Sync()
 	}
+	l.Logger.Exit(code)
 }
 
 func (l *SpotLogger) Logf(level logrus.Level, format string, args ...interface{}) {
@@ -0,0 +1,227 @@
+package spotlog
+
+import (
+	"io"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Option configures a SpotLogger created by New.
+type Option func(*config)
+
+// config collects the Option values before the SpotLogger is built.
+type config struct {
+	base         *logrus.Logger
+	out          io.Writer
+	formatter    logrus.Formatter
+	triggerLevel logrus.Level
+	trigger      Trigger
+	passthrough  bool
+	passLevel    logrus.Level
+	maxEntries   int
+	maxBytes     int
+	maxAge       time.Duration
+	shards       int
+	capture      CaptureMode
+	now          func() time.Time
+
+	spillDir       string
+	spillThreshold int
+	spillTarget    func(*usage) spillTarget
+
+	aggregate       bool
+	aggregateWindow time.Duration
+
+	windowEntries  int
+	windowDuration time.Duration
+	onStateChange  func(State)
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{
+		base:         logrus.StandardLogger(),
+		triggerLevel: logrus.ErrorLevel,
+		now:          time.Now,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithTriggerLevel sets the minimum level which outputs the stored entries.
+// Defaults to logrus.ErrorLevel.
+func WithTriggerLevel(level logrus.Level) Option {
+	return func(c *config) {
+		c.triggerLevel = level
+	}
+}
+
+// WithTrigger sets the Trigger deciding which entries output the stored
+// entries. Replaces the trigger level.
+func WithTrigger(t Trigger) Option {
+	return func(c *config) {
+		c.trigger = t
+	}
+}
+
+// WithPassthroughLevel prints entries at level or higher priority immediately
+// without printing the stored entries. The entries are also stored, so they
+// are printed in order by a later flush.
+func WithPassthroughLevel(level logrus.Level) Option {
+	return func(c *config) {
+		c.passthrough = true
+		c.passLevel = level
+	}
+}
+
+// WithOutput sets the writer the log entries are written to.
+func WithOutput(out io.Writer) Option {
+	return func(c *config) {
+		c.out = out
+	}
+}
+
+// WithFormatter sets the formatter used for the log entries.
+func WithFormatter(formatter logrus.Formatter) Option {
+	return func(c *config) {
+		c.formatter = formatter
+	}
+}
+
+// WithBaseLogger sets the logrus.Logger the SpotLogger configuration is copied
+// from. Defaults to logrus.StandardLogger(). The base logger is not modified.
+func WithBaseLogger(base *logrus.Logger) Option {
+	return func(c *config) {
+		c.base = base
+	}
+}
+
+// WithMaxEntries limits the count of entries stored by the logger and its
+// children together. The oldest entries are dropped when the limit is reached.
+// Defaults to zero, which is unlimited.
+func WithMaxEntries(n int) Option {
+	return func(c *config) {
+		c.maxEntries = n
+	}
+}
+
+// WithMaxBufferBytes limits the estimated bytes of entries stored by the
+// logger and its children together. The oldest entries are dropped when the
+// limit is reached, and the largest field values
+// of an entry are dropped when the entry alone exceeds the limit. Defaults to
+// zero, which is unlimited.
+func WithMaxBufferBytes(n int) Option {
+	return func(c *config) {
+		c.maxBytes = n
+	}
+}
+
+// WithMaxAge drops stored entries older than d. Defaults to zero, which is
+// unlimited.
+func WithMaxAge(d time.Duration) Option {
+	return func(c *config) {
+		c.maxAge = d
+	}
+}
+
+// WithSpillDir writes the oldest stored entries to temporary files in dir
+// when the entries kept in memory by a logger pass threshold estimated bytes.
+// A new file is started every MiB. The files are read back in order by a
+// flush, and deleted by a flush or discard. Files left in dir by an earlier
+// process are deleted, so dir must not be shared with other processes.
+//
+// Spilled entries are encoded as JSON lines: the message is rendered, field
+// values are encoded as JSON and the context of the entry is lost. Spilled
+// entries count toward the limits of the logger with their encoded size, and
+// the oldest file is deleted first when a limit is reached. Replaces
+// WithCompression.
+func WithSpillDir(dir string, threshold int) Option {
+	return func(c *config) {
+		c.spillDir = dir
+		c.spillThreshold = threshold
+		c.spillTarget = func(u *usage) spillTarget {
+			return &fileTarget{dir: dir, usage: u}
+		}
+	}
+}
+
+// WithCompression keeps the oldest stored entries compressed in memory when
+// the entries kept uncompressed by a logger pass threshold estimated bytes.
+// The entries are encoded the same as by WithSpillDir, collected in segments
+// and compressed with compress/flate. A flush decompresses them in order.
+// Compressed segments count toward the limits of the logger with their
+// compressed size, and the oldest segment is dropped first when a limit is
+// reached. See SpotLogger.CompressionStats. Replaces WithSpillDir.
+func WithCompression(threshold int) Option {
+	return func(c *config) {
+		c.spillDir = ""
+		c.spillThreshold = threshold
+		c.spillTarget = func(*usage) spillTarget {
+			return &compressedTarget{}
+		}
+	}
+}
+
+// WithAggregation collapses repeated entries, such as the entries of a retry
+// loop, so they don't push useful entries out of a limited buffer. An entry
+// with the same level, message format and field keys as the entry stored
+// before it is counted in that entry instead of being stored, if it is logged
+// within window of the first one. A zero window is unlimited. The collapsed
+// entry is output with the fields repeated, first and last. A logger
+// aggregating entries uses a single shard, see WithShards.
+func WithAggregation(window time.Duration) Option {
+	return func(c *config) {
+		c.aggregate = true
+		c.aggregateWindow = window
+	}
+}
+
+// WithShards sets the count of shards the entries of the logger are spread
+// over, so concurrent log calls don't contend on one lock. A goroutine stores
+// into the shard of the processor it runs on. Evicting the oldest entry
+// searches all shards, so shards only pay off for a logger shared by many
+// goroutines running in parallel. Defaults to 1. Children of the logger, and
+// loggers using WithAggregation, use a single shard.
+func WithShards(n int) Option {
+	return func(c *config) {
+		c.shards = n
+	}
+}
+
+// WithCaptureMode sets how the arguments of stored entries are captured.
+// Defaults to CaptureLazy.
+func WithCaptureMode(mode CaptureMode) Option {
+	return func(c *config) {
+		c.capture = mode
+	}
+}
+
+// WithClock sets the function returning the current time. Defaults to
+// time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(c *config) {
+		c.now = now
+	}
+}
+
+// WithPassthroughWindow prints entries immediately after a trigger, until n
+// entries are printed or d has passed, whichever is first. Zero is no limit,
+// but at least one limit must be set. The logger then returns to storing
+// entries.
+func WithPassthroughWindow(n int, d time.Duration) Option {
+	return func(c *config) {
+		c.windowEntries = n
+		c.windowDuration = d
+	}
+}
+
+// WithStateCallback sets a function called when the State of the logger
+// changes. A window closes at its last entry, or when its duration has passed
+// at the next log call or call of SpotLogger.State, which calls the function.
+func WithStateCallback(fn func(State)) Option {
+	return func(c *config) {
+		c.onStateChange = fn
+	}
+}
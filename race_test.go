@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package spotlog_test
+
+// raceEnabled is true when the race detector is enabled, which drops items
+// from sync.Pool at random.
+const raceEnabled = true
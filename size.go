@@ -0,0 +1,91 @@
+package spotlog
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"unsafe"
+)
+
+const (
+	// storedEntrySize is the fixed size of a storedEntry.
+	storedEntrySize = int(unsafe.Sizeof(storedEntry{}))
+	// interfaceSize is the size of an interface value.
+	interfaceSize = int(unsafe.Sizeof(interface{}(nil)))
+	// mapEntrySize is the estimated overhead of a map entry.
+	mapEntrySize = 32
+)
+
+// estimateSize returns the estimated bytes retained by the entry.
+func (s storedEntry) estimateSize() int {
+	size := storedEntrySize + len(s.format)
+	for _, arg := range s.args {
+		size += interfaceSize + estimateValueSize(arg)
+	}
+	for k, v := range s.data {
+		size += mapEntrySize + len(k) + estimateValueSize(v)
+	}
+	return size
+}
+
+// estimateValueSize returns the estimated bytes retained by a logged value.
+// Only the value itself is counted, pointers are not followed.
+func estimateValueSize(v interface{}) int {
+	switch v := v.(type) {
+	case nil:
+		return 0
+	case string:
+		return len(v)
+	case []byte:
+		return len(v)
+	case error:
+		return len(v.Error())
+	}
+
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.String:
+		return value.Len()
+	case reflect.Slice, reflect.Array:
+		return value.Len() * int(value.Type().Elem().Size())
+	case reflect.Map:
+		return value.Len() * mapEntrySize
+	default:
+		return int(value.Type().Size())
+	}
+}
+
+// withoutLargeFields replaces the largest field values until the entry fits
+// in maxBytes. It returns the changed entry and the count of removed values.
+func (s storedEntry) withoutLargeFields(maxBytes int) (storedEntry, int) {
+	type field struct {
+		key  string
+		size int
+	}
+	fields := make([]field, 0, len(s.data))
+	for k, v := range s.data {
+		fields = append(fields, field{k, estimateValueSize(v)})
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].size > fields[j].size
+	})
+
+	// The data is shared with the Entry, so copy it before changing it.
+	data := make(map[string]interface{}, len(s.data))
+	for k, v := range s.data {
+		data[k] = v
+	}
+
+	removed := 0
+	for _, f := range fields {
+		if s.size <= maxBytes {
+			break
+		}
+		placeholder := fmt.Sprintf("<spotlog: dropped %d bytes>", f.size)
+		data[f.key] = placeholder
+		s.size += len(placeholder) - f.size
+		removed++
+	}
+	s.data = data
+	return s, removed
+}
@@ -0,0 +1,504 @@
+package spotlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// spillPattern is the name pattern of spill files, see ioutil.TempFile.
+const spillPattern = "spotlog-*.jsonl"
+
+// spill moves the oldest entries of a buffer out of memory, or into a compact
+// form, when the entries in memory pass the threshold. The entries are encoded
+// as JSON lines and written to the segments of the target. The spilled entries
+// count toward the limits of the store with their encoded size, and the
+// oldest segment is dropped when a limit is reached.
+type spill struct {
+	mu        sync.Mutex
+	threshold int
+	target    spillTarget
+	store     *store
+
+	enc *json.Encoder
+	// origins are the loggers of the spilled entries, referenced by index.
+	origins []*SpotLogger
+
+	// count is the count of spilled entries.
+	count int
+	// segments are the segments of the target, the open segment last.
+	segments []spillSegment
+	// bytes is the size of the target, counted in the usage of the store.
+	bytes int
+	// dropped is the count of entries which failed to spill or were dropped
+	// with their segment.
+	dropped int
+	// droppedBytes is the size of the dropped segments.
+	droppedBytes int
+}
+
+// spillSegment is the count of entries of a segment and the time of the
+// first one.
+type spillSegment struct {
+	count  int
+	oldest time.Time
+}
+
+// spillTarget stores the encoded entries of a spill in segments. Entries are
+// written to the open segment, and sealed segments are dropped as a whole.
+type spillTarget interface {
+	io.Writer
+	// full returns true if the open segment should be sealed.
+	full() bool
+	// seal ends the open segment, the next write starts a new one.
+	seal() error
+	// dropOldest removes the oldest sealed segment.
+	dropOldest()
+	// size returns the bytes held by all segments.
+	size() int
+	// reader returns a reader of all segments in order.
+	reader() (io.Reader, error)
+	// reset removes all segments.
+	reset()
+}
+
+// spilledEntry is the encoding of a stored entry in a spill file.
+type spilledEntry struct {
+	Origin  int                    `json:"origin"`
+	Level   logrus.Level           `json:"level"`
+	Time    time.Time              `json:"time"`
+	Message string                 `json:"msg"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+	Caller  *spilledCaller         `json:"caller,omitempty"`
+	Always  bool                   `json:"always,omitempty"`
+	Seq     uint64                 `json:"seq"`
+
+	Repeated int        `json:"repeated,omitempty"`
+	Last     *time.Time `json:"last,omitempty"`
+}
+
+// spilledCaller is the encoding of the caller of a spilled entry.
+type spilledCaller struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+// cleanedDirs holds the spill directories cleaned by this process.
+var cleanedDirs sync.Map
+
+// cleanSpillDir deletes the spill files left in dir by an earlier process.
+// Each directory is only cleaned once per process, before it is used.
+func cleanSpillDir(dir string) {
+	if _, loaded := cleanedDirs.LoadOrStore(dir, true); loaded {
+		return
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, spillPattern))
+	for _, file := range files {
+		_ = os.Remove(file)
+	}
+}
+
+// spillOver writes the oldest entries of the buffer to the spill file, until
+// the entries in memory are within the threshold.
+func (b *buffer) spillOver() {
+	sp := b.spill
+	if sp == nil || atomic.LoadInt64(&b.bytes) <= int64(sp.threshold) {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	// The lock is held while removing the entry, so entries are written in
+	// the order they were removed.
+	for atomic.LoadInt64(&b.bytes) > int64(sp.threshold) {
+		entry, ok := b.removeOldest(false)
+		if !ok {
+			return
+		}
+		if err := sp.write(entry); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to spill log entry, %v\n", err)
+			sp.dropped++
+			continue
+		}
+		// The spilled entry still counts toward the entry limit.
+		b.add(1, 0)
+	}
+}
+
+// write appends the entry to the open segment of the target, and seals the
+// segment when it is full. Must be called with mu held.
+func (sp *spill) write(entry storedEntry) error {
+	if sp.enc == nil {
+		sp.enc = json.NewEncoder(sp.target)
+	}
+	if len(sp.segments) == 0 {
+		sp.segments = append(sp.segments, spillSegment{})
+	}
+	err := sp.enc.Encode(sp.encode(entry))
+	if err == nil {
+		segment := &sp.segments[len(sp.segments)-1]
+		if segment.count == 0 {
+			segment.oldest = entry.time
+		}
+		segment.count++
+		sp.count++
+		if sp.target.full() {
+			err = sp.seal()
+		}
+	}
+	sp.resize()
+	return err
+}
+
+// seal seals the open segment of the target. Must be called with mu held.
+func (sp *spill) seal() error {
+	if err := sp.target.seal(); err != nil {
+		return err
+	}
+	sp.segments = append(sp.segments, spillSegment{})
+	return nil
+}
+
+// resize counts the change of the size of the target in the usage of the
+// store. Must be called with mu held.
+func (sp *spill) resize() {
+	size := sp.target.size()
+	sp.store.usage.add(size - sp.bytes)
+	sp.bytes = size
+}
+
+// oldest returns the time of the oldest spilled entry. Returns false if there
+// are none.
+func (sp *spill) oldest() (time.Time, bool) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if sp.count == 0 {
+		return time.Time{}, false
+	}
+	return sp.segments[0].oldest, true
+}
+
+// evictOldest drops the oldest segment, counting its entries as dropped. The
+// open segment is sealed first if it is the only one. Returns false if it can
+// not be sealed.
+func (sp *spill) evictOldest() bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if sp.count == 0 {
+		// Removed by another goroutine.
+		return true
+	}
+	if len(sp.segments) == 1 {
+		if err := sp.seal(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to drop spilled log entries, %v\n", err)
+			return false
+		}
+	}
+	segment := sp.segments[0]
+	sp.segments = sp.segments[1:]
+	sp.target.dropOldest()
+	bytes := sp.bytes
+	sp.resize()
+	sp.count -= segment.count
+	sp.dropped += segment.count
+	sp.droppedBytes += bytes - sp.bytes
+	if sp.store.limited() {
+		atomic.AddInt64(&sp.store.count, -int64(segment.count))
+	}
+	return true
+}
+
+// encode converts an entry to its encoding. Must be called with mu held.
+func (sp *spill) encode(entry storedEntry) spilledEntry {
+	origin := -1
+	for i, logger := range sp.origins {
+		if logger == entry.origin {
+			origin = i
+			break
+		}
+	}
+	if origin < 0 {
+		origin = len(sp.origins)
+		sp.origins = append(sp.origins, entry.origin)
+	}
+
+	var data map[string]interface{}
+	if len(entry.data) > 0 {
+		data = make(map[string]interface{}, len(entry.data))
+		for k, v := range entry.data {
+			data[k] = encodeValue(v)
+		}
+	}
+	var caller *spilledCaller
+	if entry.caller != nil {
+		caller = &spilledCaller{
+			Function: entry.caller.Function,
+			File:     entry.caller.File,
+			Line:     entry.caller.Line,
+		}
+	}
+	var last *time.Time
+	if !entry.last.IsZero() {
+		last = &entry.last
+	}
+	return spilledEntry{
+		Origin:   origin,
+		Level:    entry.level,
+		Time:     entry.time,
+		Message:  entry.message(),
+		Data:     data,
+		Caller:   caller,
+		Always:   entry.always,
+		Seq:      entry.seq,
+		Repeated: entry.repeated,
+		Last:     last,
+	}
+}
+
+// encodeValue encodes a field value as JSON. Errors and values which can not
+// be encoded are encoded as strings.
+func encodeValue(v interface{}) json.RawMessage {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		raw, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return raw
+}
+
+// decode converts an encoded entry back to an entry.
+func (sp *spill) decode(e spilledEntry) storedEntry {
+	var origin *SpotLogger
+	if e.Origin >= 0 && e.Origin < len(sp.origins) {
+		origin = sp.origins[e.Origin]
+	}
+	var caller *runtime.Frame
+	if e.Caller != nil {
+		caller = &runtime.Frame{
+			Function: e.Caller.Function,
+			File:     e.Caller.File,
+			Line:     e.Caller.Line,
+		}
+	}
+	stored := storedEntry{
+		origin: origin,
+		method: printLog,
+		level:  e.Level,
+		args:   []interface{}{e.Message},
+		data:   e.Data,
+		time:   e.Time,
+		caller: caller,
+		always: e.Always,
+		seq:    e.Seq,
+	}
+	stored.repeated = e.Repeated
+	if e.Last != nil {
+		stored.last = *e.Last
+	}
+	return stored
+}
+
+// spillReader reads the spilled entries in order.
+type spillReader struct {
+	sp  *spill
+	dec *json.Decoder
+}
+
+// reader returns a reader of the spilled entries, nil if there are none. Must
+// be called with mu held.
+func (sp *spill) reader() *spillReader {
+	if sp.count == 0 {
+		return nil
+	}
+	r, err := sp.target.reader()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read spilled log entries, %v\n", err)
+		return nil
+	}
+	dec := json.NewDecoder(r)
+	// Keep integers as they were logged instead of converting them to float64.
+	dec.UseNumber()
+	return &spillReader{sp: sp, dec: dec}
+}
+
+// next returns the next spilled entry. Returns false at the end of the file.
+func (r *spillReader) next() (storedEntry, bool) {
+	var e spilledEntry
+	if err := r.dec.Decode(&e); err != nil {
+		if err != io.EOF {
+			fmt.Fprintf(os.Stderr, "Failed to read spilled log entries, %v\n", err)
+		}
+		return storedEntry{}, false
+	}
+	return r.sp.decode(e), true
+}
+
+// addDrops adds the dropped counts and the time of the oldest spilled entry
+// to d. Must be called with mu held.
+func (sp *spill) addDrops(d *drops) {
+	d.entries += sp.dropped
+	d.bytes += sp.droppedBytes
+	if sp.count > 0 && (d.oldest.IsZero() || sp.segments[0].oldest.Before(d.oldest)) {
+		d.oldest = sp.segments[0].oldest
+	}
+}
+
+// reset removes the spilled entries. Returns the count and size of the
+// removed entries, which are left in the usage of the store. Must be called
+// with mu held.
+func (sp *spill) reset() (count int, bytes int) {
+	count, bytes = sp.count, sp.bytes
+	sp.target.reset()
+	sp.enc = nil
+	sp.origins = nil
+	sp.count = 0
+	sp.segments = nil
+	sp.bytes = 0
+	sp.dropped = 0
+	sp.droppedBytes = 0
+	return count, bytes
+}
+
+// fileSegmentSize is the size of a spill file before the following entries
+// are written to a new file.
+const fileSegmentSize = 1 << 20
+
+// fileTarget writes the spilled entries to temporary files, one per segment.
+// The file of the open segment is created at the first write.
+type fileTarget struct {
+	dir string
+	// usage deletes the files if the logger is garbage collected without a
+	// flush or discard.
+	usage *usage
+	file  *os.File
+	w     *bufio.Writer
+	// written is the size of the open file.
+	written int
+
+	// sealed are the sealed files, oldest first.
+	sealed []sealedFile
+	// sealedBytes is the size of the sealed files.
+	sealedBytes int
+}
+
+// sealedFile is the name and size of a sealed spill file.
+type sealedFile struct {
+	name string
+	size int
+}
+
+func (t *fileTarget) Write(p []byte) (int, error) {
+	if t.file == nil {
+		file, err := ioutil.TempFile(t.dir, spillPattern)
+		if err != nil {
+			return 0, err
+		}
+		t.usage.addFile(file.Name())
+		t.file = file
+		t.w = bufio.NewWriter(file)
+	}
+	n, err := t.w.Write(p)
+	t.written += n
+	return n, err
+}
+
+func (t *fileTarget) full() bool {
+	return t.written >= fileSegmentSize
+}
+
+// seal closes the open file.
+func (t *fileTarget) seal() error {
+	if t.file == nil {
+		return nil
+	}
+	err := t.w.Flush()
+	if closeErr := t.file.Close(); err == nil {
+		err = closeErr
+	}
+	t.sealed = append(t.sealed, sealedFile{name: t.file.Name(), size: t.written})
+	t.sealedBytes += t.written
+	t.file = nil
+	t.w = nil
+	t.written = 0
+	return err
+}
+
+// dropOldest deletes the oldest sealed file.
+func (t *fileTarget) dropOldest() {
+	if len(t.sealed) == 0 {
+		return
+	}
+	t.usage.removeFile(t.sealed[0].name)
+	t.sealedBytes -= t.sealed[0].size
+	t.sealed = t.sealed[1:]
+}
+
+func (t *fileTarget) size() int {
+	return t.sealedBytes + t.written
+}
+
+func (t *fileTarget) reader() (io.Reader, error) {
+	readers := make([]io.Reader, 0, len(t.sealed)+1)
+	for _, sealed := range t.sealed {
+		readers = append(readers, &fileReader{name: sealed.name})
+	}
+	if t.file != nil {
+		if err := t.w.Flush(); err != nil {
+			return nil, err
+		}
+		if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		readers = append(readers, t.file)
+	}
+	return bufio.NewReader(io.MultiReader(readers...)), nil
+}
+
+// reset deletes the files.
+func (t *fileTarget) reset() {
+	if t.file != nil {
+		_ = t.file.Close()
+		t.usage.removeFile(t.file.Name())
+	}
+	for _, sealed := range t.sealed {
+		t.usage.removeFile(sealed.name)
+	}
+	*t = fileTarget{dir: t.dir, usage: t.usage}
+}
+
+// fileReader reads a sealed spill file, opened at the first read and closed
+// at the end.
+type fileReader struct {
+	name string
+	file *os.File
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	if r.file == nil {
+		file, err := os.Open(r.name)
+		if err != nil {
+			return 0, err
+		}
+		r.file = file
+	}
+	n, err := r.file.Read(p)
+	if err == io.EOF {
+		_ = r.file.Close()
+	}
+	return n, err
+}
@@ -2,6 +2,10 @@ package spotlog
 
 import (
 	"context"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -18,15 +22,74 @@ const (
 
 // storedEntry contains the arguments of stored Log Entry.
 type storedEntry struct {
+	// origin is the logger the entry was logged by.
+	origin *SpotLogger
+
 	method printType
 	level  logrus.Level
 	format string
 	args   []interface{}
+
+	// data, time, ctx and caller are captured when the entry is logged, so
+	// the entry is output the same as it would have been by logrus.
+	data   logrus.Fields
+	time   time.Time
+	ctx    context.Context
+	caller *runtime.Frame
+	// always prints the entry immediately, see Entry.Always.
+	always bool
+
+	// size is the estimated bytes retained by the entry, set when stored.
+	size int
+	// seq is the order the entry was stored in by the store, see store.seq.
+	seq uint64
+
+	// repeated is the count of log calls collapsed into the entry, zero if
+	// none were, see WithAggregation.
+	repeated int
+	// last is the time of the last log call collapsed into the entry.
+	last time.Time
+}
+
+// before orders entries by time, then by the order they were stored.
+func (s *storedEntry) before(other *storedEntry) bool {
+	if s.time.Equal(other.time) {
+		return s.seq < other.seq
+	}
+	return s.time.Before(other.time)
+}
+
+// message renders the message of the entry using the print method it was
+// logged with.
+func (s storedEntry) message() string {
+	switch s.method {
+	case printLogf:
+		return fmt.Sprintf(s.format, s.args...)
+	case printLogln:
+		return sprintlnn(s.args...)
+	default:
+		return fmt.Sprint(s.args...)
+	}
+}
+
+// sprintlnn => Sprint no newline. This is to get the behavior of how
+// fmt.Sprintln where spaces are always added between operands, regardless of
+// their type. Instead of vendoring the Sprintln implementation to spare a
+// string allocation, we do the simplest thing.
+func sprintlnn(args ...interface{}) string {
+	msg := fmt.Sprintln(args...)
+	return msg[:len(msg)-1]
+}
+
+// fromContext returns the logger in the context, if any.
+func fromContext(ctx context.Context) (*SpotLogger, bool) {
+	logger, ok := ctx.Value(loggerKey).(*SpotLogger)
+	return logger, ok
 }
 
 // Get returns the logger in the context or creates one.
 func Get(ctx context.Context) (context.Context, *SpotLogger) {
-	logger, ok := ctx.Value(loggerKey).(*SpotLogger)
+	logger, ok := fromContext(ctx)
 
 	if ok {
 		return ctx, logger
@@ -42,3 +105,70 @@ func Get(ctx context.Context) (context.Context, *SpotLogger) {
 func Set(ctx context.Context, logger *SpotLogger) context.Context {
 	return context.WithValue(ctx, loggerKey, logger)
 }
+
+// Fork creates a child of the logger in the context, see SpotLogger.Child,
+// and returns a context containing the child. The entries of the child are
+// tagged with a fork field numbering the children of the tree.
+func Fork(ctx context.Context) (context.Context, *SpotLogger) {
+	_, parent := Get(ctx)
+
+	parent.store.mu.Lock()
+	parent.store.forks++
+	fork := parent.store.forks
+	parent.store.mu.Unlock()
+
+	child := parent.Child(logrus.Fields{"fork": fork})
+	return Set(ctx, child), child
+}
+
+// Finish ends the scope of the logger in the context. The stored entries are
+// flushed if the error errp points to is non-nil or a panic is in progress,
+// otherwise they are discarded. A panic continues after the flush. It must be
+// deferred directly:
+//
+//	func handle(ctx context.Context) (err error) {
+//		defer spotlog.Finish(ctx, &err)
+//		...
+//	}
+func Finish(ctx context.Context, errp *error) {
+	r := recover()
+
+	if logger, ok := fromContext(ctx); ok {
+		if r != nil || errp != nil && *errp != nil {
+			logger.Flush()
+		} else {
+			logger.Discard()
+		}
+	}
+
+	if r != nil {
+		panic(r)
+	}
+}
+
+// RecoverAndFlush flushes the stored entries of the logger in the context
+// when a panic is in progress, followed by the panic value and stack, then
+// continues the panic. Use it to print the history of goroutines which crash,
+// it must be deferred directly:
+//
+//	go func() {
+//		defer spotlog.RecoverAndFlush(ctx)
+//		...
+//	}()
+func RecoverAndFlush(ctx context.Context) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	_, logger := Get(ctx)
+	logger.Flush()
+	// A panic started by a Panic entry is already printed.
+	if _, ok := r.(*logrus.Entry); !ok {
+		logger.WithFields(logrus.Fields{
+			"panic": r,
+			"stack": string(debug.Stack()),
+		}).Always().Error("recovered panic")
+	}
+	panic(r)
+}
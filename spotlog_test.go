@@ -2,11 +2,22 @@ package spotlog_test
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"context"
 
@@ -16,8 +27,8 @@ import (
 )
 
 // The logrus.FieldLogger interface is implemented near exactly, but changed
-// to return spotlog.Entry.
-// var logruslogger logrus.FieldLogger = logger
+// to return spotlog.Entry. Use SpotLogger.FieldLogger() to get a view
+// implementing logrus.FieldLogger.
 
 func TestLogger(t *testing.T) {
 	ctx := context.Background()
@@ -61,6 +72,1144 @@ func TestEntry(t *testing.T) {
 	assert.Contains(t, stdout.String(), "msg=errormsg test=value")
 }
 
+func TestTriggerLevel(t *testing.T) {
+	var stdout bytes.Buffer
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithTriggerLevel(logrus.WarnLevel),
+	)
+	assert.Equal(t, logrus.WarnLevel, logger.TriggerLevel())
+
+	logger.Info("infomsg")
+	assert.Empty(t, stdout.String())
+
+	logger.Warn("warnmsg")
+	assert.Contains(t, stdout.String(), "infomsg")
+	assert.Contains(t, stdout.String(), "warnmsg")
+
+	stdout.Reset()
+	logger.SetTriggerLevel(logrus.ErrorLevel)
+	logger.Warn("warnmsg")
+	assert.Empty(t, stdout.String())
+}
+
+func TestNewWithLogger(t *testing.T) {
+	var stdout bytes.Buffer
+	base := logrus.New()
+	base.Out = &stdout
+	base.Level = logrus.InfoLevel
+
+	logger := spotlog.NewWithLogger(base)
+	logger.Debug("debugmsg")
+	logger.Error("errormsg")
+	assert.Contains(t, stdout.String(), "debugmsg")
+	assert.Contains(t, stdout.String(), "errormsg")
+	assert.Equal(t, logrus.InfoLevel, base.Level)
+
+	var other bytes.Buffer
+	logger.Out = &other
+	assert.Equal(t, &stdout, base.Out)
+	assert.NotEqual(t, &other, logrus.StandardLogger().Out)
+
+	logger.AddHook(spotlog.Hook{})
+	assert.Empty(t, base.Hooks)
+}
+
+func TestSharedOutput(t *testing.T) {
+	var stdout bytes.Buffer
+	base := logrus.New()
+	base.Out = &stdout
+
+	// Loggers cloned from one base write to its output one at a time.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger := spotlog.NewWithLogger(base)
+			logger.Debug("debugmsg")
+			logger.Error("errormsg")
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 8, strings.Count(stdout.String(), "debugmsg"))
+	assert.Equal(t, 8, strings.Count(stdout.String(), "errormsg"))
+}
+
+func TestStoredEntryFields(t *testing.T) {
+	var stdout bytes.Buffer
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.JSONFormatter{}),
+	)
+	logger.ReportCaller = true
+
+	past := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	logger.WithField("first", "value").WithTime(past).Debug("debugmsg")
+	logger.WithField("second", "value").Error("errormsg")
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	assert.Len(t, lines, 2)
+
+	var first, second map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &second))
+
+	assert.Equal(t, "debugmsg", first["msg"])
+	assert.Equal(t, "value", first["first"])
+	assert.NotContains(t, first, "second")
+	assert.Equal(t, past.Format(time.RFC3339), first["time"])
+	assert.Contains(t, first["func"], "TestStoredEntryFields")
+
+	assert.Equal(t, "errormsg", second["msg"])
+	assert.Equal(t, "value", second["second"])
+	assert.NotContains(t, second, "first")
+	assert.Contains(t, second["func"], "TestStoredEntryFields")
+}
+
+func TestMaxEntries(t *testing.T) {
+	var stdout bytes.Buffer
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+		spotlog.WithMaxEntries(2),
+	)
+
+	for i := 1; i <= 5; i++ {
+		logger.Debugf("debugmsg%d", i)
+	}
+	logger.Error("errormsg")
+
+	assert.Equal(t, `level=warning msg="spotlog: 3 earlier entries dropped"
+level=debug msg=debugmsg4
+level=debug msg=debugmsg5
+level=error msg=errormsg
+`, stdout.String())
+
+	// The dropped count is reset by the flush.
+	stdout.Reset()
+	logger.Debug("debugmsg")
+	logger.Error("errormsg")
+	assert.NotContains(t, stdout.String(), "dropped")
+}
+
+func TestShards(t *testing.T) {
+	var stdout bytes.Buffer
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+		spotlog.WithMaxEntries(3),
+		spotlog.WithShards(4),
+	)
+
+	// The oldest entries are evicted across shards.
+	for i := 1; i <= 6; i++ {
+		logger.Debugf("debugmsg%d", i)
+	}
+	logger.Error("errormsg")
+	assert.Equal(t, `level=warning msg="spotlog: 3 earlier entries dropped"
+level=debug msg=debugmsg4
+level=debug msg=debugmsg5
+level=debug msg=debugmsg6
+level=error msg=errormsg
+`, stdout.String())
+
+	// The limit is approximate while goroutines evict at the same time.
+	stdout.Reset()
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 10; n++ {
+				logger.Debug("workermsg")
+			}
+		}()
+	}
+	wg.Wait()
+	logger.Error("errormsg")
+	assert.Contains(t, stdout.String(), "earlier entries dropped")
+	assert.InDelta(t, 3, strings.Count(stdout.String(), "workermsg"), 2)
+}
+
+func TestCaptureMode(t *testing.T) {
+	type point struct{ X, Y int }
+	tests := []struct {
+		mode     spotlog.CaptureMode
+		expected string
+	}{
+		{spotlog.CaptureLazy, `level=debug msg="p=&{2 2}" n=1 p="&{2 2}"`},
+		{spotlog.CaptureSnapshot, `level=debug msg="p=&{1 1}" n=1 p="&{1 1}"`},
+	}
+	for _, test := range tests {
+		t.Run(test.mode.String(), func(t *testing.T) {
+			var stdout bytes.Buffer
+			logger := spotlog.New(
+				spotlog.WithOutput(&stdout),
+				spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+				spotlog.WithCaptureMode(test.mode),
+			)
+
+			p := &point{1, 1}
+			logger.WithField("p", p).WithField("n", 1).Debugf("p=%v", p)
+			p.X, p.Y = 2, 2
+			logger.Error("errormsg")
+			assert.Contains(t, stdout.String(), test.expected)
+		})
+	}
+}
+
+func TestDiscardAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations are counted without the race detector")
+	}
+	logger := spotlog.New(spotlog.WithOutput(ioutil.Discard))
+
+	// Only the arguments of the entry are allocated.
+	allocs := testing.AllocsPerRun(1000, func() {
+		logger.Debug("debugmsg")
+		logger.Discard()
+	})
+	assert.LessOrEqual(t, allocs, 1.0)
+
+	// A field adds the entry and its fields map.
+	allocs = testing.AllocsPerRun(1000, func() {
+		logger.WithField("key", "value").Debug("debugmsg")
+		logger.Discard()
+	})
+	assert.LessOrEqual(t, allocs, 4.0)
+}
+
+func TestSpillDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spotlog")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	spillFiles := func() []string {
+		files, _ := filepath.Glob(filepath.Join(dir, "spotlog-*.jsonl"))
+		return files
+	}
+
+	// Files left by an earlier process are deleted.
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "spotlog-1.jsonl"), []byte("{}\n"), 0600))
+	var stdout bytes.Buffer
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+		spotlog.WithSpillDir(dir, 1000),
+	)
+	assert.Empty(t, spillFiles())
+
+	for i := 0; i < 50; i++ {
+		logger.WithField("n", i).WithError(errNotFound).Debugf("debugmsg%d", i)
+	}
+	assert.Len(t, spillFiles(), 1)
+	assert.Empty(t, stdout.String())
+
+	logger.Error("errormsg")
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	assert.Len(t, lines, 51)
+	for i := 0; i < 50; i++ {
+		assert.Equal(t, fmt.Sprintf(`level=debug msg=debugmsg%d error="not found" n=%d`, i, i), lines[i])
+	}
+	assert.Empty(t, spillFiles())
+
+	for i := 0; i < 50; i++ {
+		logger.Debugf("debugmsg%d", i)
+	}
+	assert.Len(t, spillFiles(), 1)
+	logger.Discard()
+	assert.Empty(t, spillFiles())
+}
+
+func TestCompression(t *testing.T) {
+	var stdout bytes.Buffer
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+		spotlog.WithCompression(1000),
+	)
+
+	for i := 0; i < 2000; i++ {
+		logger.WithField("n", i).Debugf("debugmsg%d", i)
+	}
+	stats := logger.CompressionStats()
+	assert.Greater(t, stats.Entries, 1900)
+	assert.Greater(t, stats.Segments, 0)
+	assert.Greater(t, stats.Ratio(), 2.0)
+	assert.Empty(t, stdout.String())
+
+	logger.Error("errormsg")
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	assert.Len(t, lines, 2001)
+	for i := 0; i < 2000; i++ {
+		assert.Equal(t, fmt.Sprintf("level=debug msg=debugmsg%d n=%d", i, i), lines[i])
+	}
+	assert.Equal(t, spotlog.CompressionStats{}, logger.CompressionStats())
+}
+
+func TestSpillLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spotlog")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Spilled entries count toward the byte limit, the oldest files are
+	// deleted.
+	var stdout bytes.Buffer
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+		spotlog.WithSpillDir(dir, 10000),
+		spotlog.WithMaxBufferBytes(3<<20),
+	)
+	body := strings.Repeat("b", 1000)
+	for i := 0; i < 5000; i++ {
+		logger.WithField("body", body).Debugf("debugmsg%d", i)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "spotlog-*.jsonl"))
+	assert.LessOrEqual(t, len(files), 4)
+	var size int64
+	for _, file := range files {
+		info, err := os.Stat(file)
+		assert.NoError(t, err)
+		size += info.Size()
+	}
+	assert.LessOrEqual(t, size, int64(3<<20))
+
+	logger.Error("errormsg")
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	assert.Contains(t, lines[0], "earlier entries dropped")
+	assert.Contains(t, lines[len(lines)-2], "msg=debugmsg4999")
+	assert.Less(t, len(lines), 5000)
+}
+
+func TestCompressionLimits(t *testing.T) {
+	collectGarbage()
+	start := spotlog.GlobalBufferBytes()
+	spotlog.SetGlobalMaxBufferBytes(start + 50000)
+	defer spotlog.SetGlobalMaxBufferBytes(0)
+
+	// Compressed segments count toward the global budget, the oldest
+	// segments are dropped.
+	var stdout bytes.Buffer
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+		spotlog.WithCompression(1000),
+	)
+	for i := 0; i < 20000; i++ {
+		logger.WithField("n", i).Debugf("debugmsg%d", i)
+	}
+	assert.LessOrEqual(t, spotlog.GlobalBufferBytes(), start+50000)
+	stats := logger.CompressionStats()
+	assert.LessOrEqual(t, stats.CompressedBytes, 50000)
+	assert.Less(t, stats.Entries, 20000)
+
+	logger.Error("errormsg")
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	assert.Contains(t, lines[0], "earlier entries dropped")
+	assert.Equal(t, "level=debug msg=debugmsg19999 n=19999", lines[len(lines)-2])
+	assert.Equal(t, start, spotlog.GlobalBufferBytes())
+}
+
+func TestAggregation(t *testing.T) {
+	start := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, shards := range []int{1, 4} {
+		t.Run(fmt.Sprintf("shards=%d", shards), func(t *testing.T) {
+			var stdout bytes.Buffer
+			now := start
+			logger := spotlog.New(
+				spotlog.WithOutput(&stdout),
+				spotlog.WithFormatter(&logrus.JSONFormatter{DisableTimestamp: true}),
+				spotlog.WithClock(func() time.Time { return now }),
+				spotlog.WithMaxEntries(3),
+				spotlog.WithShards(shards),
+				spotlog.WithAggregation(0),
+			)
+
+			logger.Debug("startmsg")
+			for i := 0; i < 1000; i++ {
+				now = now.Add(time.Second)
+				logger.WithField("attempt", i).Debug("retrying")
+			}
+			logger.Debug("gave up")
+			logger.Error("errormsg")
+
+			lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+			assert.Len(t, lines, 4)
+			assert.Contains(t, lines[0], "startmsg")
+			assert.Contains(t, lines[1], `"first":"2020-05-01T12:00:01Z"`)
+			assert.Contains(t, lines[1], `"last":"2020-05-01T12:16:40Z"`)
+			assert.Contains(t, lines[1], `"msg":"retrying","repeated":1000`)
+			assert.Contains(t, lines[2], "gave up")
+		})
+	}
+
+	t.Run("interleaved", func(t *testing.T) {
+		var stdout bytes.Buffer
+		logger := spotlog.New(
+			spotlog.WithOutput(&stdout),
+			spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+			spotlog.WithShards(2),
+			spotlog.WithAggregation(0),
+		)
+
+		// Only an entry repeating the newest entry is collapsed.
+		for i := 0; i < 2; i++ {
+			logger.Debug("retrying")
+			logger.Debug("connect failed")
+		}
+		logger.Error("errormsg")
+		assert.Equal(t, `level=debug msg=retrying
+level=debug msg="connect failed"
+level=debug msg=retrying
+level=debug msg="connect failed"
+level=error msg=errormsg
+`, stdout.String())
+	})
+
+	t.Run("uncomparable", func(t *testing.T) {
+		type holder struct{ v interface{} }
+		var stdout bytes.Buffer
+		logger := spotlog.New(
+			spotlog.WithOutput(&stdout),
+			spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+			spotlog.WithAggregation(0),
+		)
+
+		// Comparing a slice in an interface field panics, so the entries
+		// are not collapsed.
+		logger.Debug(holder{[]int{1}})
+		logger.Debug(holder{[]int{1}})
+		logger.Error("errormsg")
+		assert.Equal(t, `level=debug msg="{[1]}"
+level=debug msg="{[1]}"
+level=error msg=errormsg
+`, stdout.String())
+	})
+
+	t.Run("text", func(t *testing.T) {
+		var stdout bytes.Buffer
+		logger := spotlog.New(
+			spotlog.WithOutput(&stdout),
+			spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true, TimestampFormat: time.RFC3339Nano}),
+			spotlog.WithAggregation(0),
+		)
+
+		// The times are formatted like timestamps, without the monotonic
+		// clock reading of time.Now.
+		for i := 0; i < 3; i++ {
+			logger.Debug("retrying")
+		}
+		logger.Error("errormsg")
+		lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+		assert.Len(t, lines, 2)
+		assert.Regexp(t, `^level=debug msg=retrying first="[^ ]+" last="[^ ]+" repeated=3$`, lines[0])
+		for _, key := range []string{"first", "last"} {
+			value := lines[0][strings.Index(lines[0], key+`="`)+len(key)+2:]
+			_, err := time.Parse(time.RFC3339Nano, value[:strings.Index(value, `"`)])
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("window", func(t *testing.T) {
+		var stdout bytes.Buffer
+		now := start
+		logger := spotlog.New(
+			spotlog.WithOutput(&stdout),
+			spotlog.WithFormatter(&logrus.JSONFormatter{DisableTimestamp: true}),
+			spotlog.WithClock(func() time.Time { return now }),
+			spotlog.WithShards(1),
+			spotlog.WithAggregation(10*time.Second),
+		)
+
+		for i := 0; i < 25; i++ {
+			now = now.Add(time.Second)
+			logger.Debugf("retrying %d", i)
+		}
+		logger.Error("errormsg")
+		assert.Equal(t, 2, strings.Count(stdout.String(), `"repeated":11`))
+		assert.Equal(t, 1, strings.Count(stdout.String(), `"repeated":3`))
+	})
+}
+
+func TestMaxBufferBytes(t *testing.T) {
+	var stdout bytes.Buffer
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+		spotlog.WithMaxBufferBytes(2000),
+	)
+
+	body := strings.Repeat("b", 500)
+	for i := 1; i <= 5; i++ {
+		logger.WithField("body", body).Debugf("debugmsg%d", i)
+	}
+	logger.WithField("body", strings.Repeat("b", 10000)).Debug("largemsg")
+	logger.Error("errormsg")
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	assert.Contains(t, lines[0], "earlier entries dropped")
+	assert.Contains(t, lines[0], "dropped_bytes=")
+	assert.Contains(t, lines[0], "dropped_fields=1")
+	assert.NotContains(t, stdout.String(), "debugmsg1")
+	assert.Contains(t, lines[len(lines)-2], "msg=largemsg")
+	assert.Contains(t, lines[len(lines)-2], "<spotlog: dropped 10000 bytes>")
+	assert.Contains(t, lines[len(lines)-1], "msg=errormsg")
+}
+
+// collectGarbage runs the garbage collector until the finalizers of the
+// loggers dropped by earlier tests have run.
+func collectGarbage() {
+	for i := 0; i < 5; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGlobalMaxBufferBytes(t *testing.T) {
+	collectGarbage()
+	start := spotlog.GlobalBufferBytes()
+	spotlog.SetGlobalMaxBufferBytes(start + 3000)
+	defer spotlog.SetGlobalMaxBufferBytes(0)
+
+	var stdout bytes.Buffer
+	first := spotlog.New(spotlog.WithOutput(&stdout))
+	second := spotlog.New(spotlog.WithOutput(&stdout))
+
+	body := strings.Repeat("b", 500)
+	for i := 0; i < 10; i++ {
+		first.WithField("body", body).Debug("first")
+		second.WithField("body", body).Debug("second")
+		assert.LessOrEqual(t, spotlog.GlobalBufferBytes(), start+3000)
+	}
+
+	second.Error("errormsg")
+	assert.Contains(t, stdout.String(), "earlier entries dropped")
+	assert.Contains(t, stdout.String(), "msg=second")
+
+	first.Error("errormsg")
+	assert.Equal(t, start, spotlog.GlobalBufferBytes())
+}
+
+func TestGlobalMaxBufferBytesIdle(t *testing.T) {
+	collectGarbage()
+	start := spotlog.GlobalBufferBytes()
+	spotlog.SetGlobalMaxBufferBytes(start + 2000)
+	defer spotlog.SetGlobalMaxBufferBytes(0)
+
+	// An idle logger holds most of the budget, a new logger still keeps its
+	// newest entry.
+	var idleout, stdout bytes.Buffer
+	idle := spotlog.New(spotlog.WithOutput(&idleout))
+	idle.WithField("body", strings.Repeat("b", 1500)).Debug("idlemsg")
+	logger := spotlog.New(spotlog.WithOutput(&stdout))
+	logger.WithField("body", strings.Repeat("b", 200)).Debug("first")
+	logger.WithField("body", strings.Repeat("b", 200)).Debug("second")
+	logger.Error("errormsg")
+	assert.Contains(t, stdout.String(), "1 earlier entries dropped")
+	assert.NotContains(t, stdout.String(), "msg=first")
+	assert.Contains(t, stdout.String(), "msg=second")
+	assert.Contains(t, stdout.String(), "msg=errormsg")
+
+	idle.Error("errormsg")
+	assert.Contains(t, idleout.String(), "msg=idlemsg")
+}
+
+func TestUnlimitedNotCounted(t *testing.T) {
+	collectGarbage()
+	start := spotlog.GlobalBufferBytes()
+	logger := spotlog.New(spotlog.WithOutput(ioutil.Discard))
+	for i := 0; i < 100; i++ {
+		logger.WithField("body", strings.Repeat("b", 500)).Debug("debugmsg")
+	}
+	assert.LessOrEqual(t, spotlog.GlobalBufferBytes(), start)
+}
+
+func TestGarbageCollected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spotlog")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Entries are only counted with a limit.
+	spotlog.SetGlobalMaxBufferBytes(1 << 40)
+	defer spotlog.SetGlobalMaxBufferBytes(0)
+
+	collectGarbage()
+	start := spotlog.GlobalBufferBytes()
+	func() {
+		for i := 0; i < 1000; i++ {
+			logger := spotlog.New(spotlog.WithOutput(ioutil.Discard))
+			ctx := spotlog.Set(context.Background(), logger)
+			// The context references the logger from its own buffer.
+			logger.WithContext(ctx).Debug("debugmsg")
+		}
+		for i := 0; i < 10; i++ {
+			logger := spotlog.New(spotlog.WithOutput(ioutil.Discard), spotlog.WithSpillDir(dir, 100))
+			for j := 0; j < 10; j++ {
+				logger.Debug("debugmsg")
+			}
+		}
+	}()
+	assert.Greater(t, spotlog.GlobalBufferBytes(), start)
+	files, _ := filepath.Glob(filepath.Join(dir, "spotlog-*.jsonl"))
+	assert.Len(t, files, 10)
+
+	collectGarbage()
+	assert.LessOrEqual(t, spotlog.GlobalBufferBytes(), start)
+	files, _ = filepath.Glob(filepath.Join(dir, "spotlog-*.jsonl"))
+	assert.Empty(t, files)
+}
+
+func TestMaxAge(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	var stdout bytes.Buffer
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+		spotlog.WithMaxAge(time.Minute),
+		spotlog.WithClock(func() time.Time { return now }),
+	)
+
+	logger.Debug("debugmsg1")
+	now = now.Add(30 * time.Second)
+	logger.Debug("debugmsg2")
+	now = now.Add(45 * time.Second)
+	logger.Debug("debugmsg3")
+	now = now.Add(30 * time.Second)
+	logger.Error("errormsg")
+
+	assert.Equal(t, `level=warning msg="spotlog: 2 earlier entries dropped"
+level=debug msg=debugmsg3
+level=error msg=errormsg
+`, stdout.String())
+}
+
+func TestAlways(t *testing.T) {
+	var stdout bytes.Buffer
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+	)
+
+	logger.Debug("debugmsg1")
+	logger.WithField("user", "alice").Always().Info("auditmsg")
+	assert.Equal(t, "level=info msg=auditmsg user=alice\n", stdout.String())
+
+	stdout.Reset()
+	logger.Debug("debugmsg2")
+	logger.Error("errormsg")
+	assert.Equal(t, `level=debug msg=debugmsg1
+level=info msg=auditmsg user=alice
+level=debug msg=debugmsg2
+level=error msg=errormsg
+`, stdout.String())
+
+	// The entry returned by Always is not shared with later entries.
+	stdout.Reset()
+	entry := logger.Always()
+	entry.Data["user"] = "bob"
+	entry.Info("auditmsg")
+	logger.WithField("n", 1).Error("errormsg")
+	logger.Always().Info("auditmsg")
+	assert.Equal(t, `level=info msg=auditmsg user=bob
+level=info msg=auditmsg user=bob
+level=error msg=errormsg n=1
+level=info msg=auditmsg
+`, stdout.String())
+}
+
+func TestPassthroughLevel(t *testing.T) {
+	var stdout bytes.Buffer
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+		spotlog.WithPassthroughLevel(logrus.InfoLevel),
+	)
+
+	logger.Debug("debugmsg")
+	assert.Empty(t, stdout.String())
+	logger.Info("infomsg")
+	assert.Equal(t, "level=info msg=infomsg\n", stdout.String())
+
+	stdout.Reset()
+	logger.Error("errormsg")
+	assert.Equal(t, `level=debug msg=debugmsg
+level=info msg=infomsg
+level=error msg=errormsg
+`, stdout.String())
+}
+
+func TestGlobalFields(t *testing.T) {
+	ctx, logger := spotlog.Get(context.Background())
+
+	var stdout bytes.Buffer
+	logger.Out = &stdout
+	logger.Formatter = &logrus.TextFormatter{DisableTimestamp: true}
+	logger.WithGlobalFields(logrus.Fields{"route": "/users"})
+
+	logger.Debug("debugmsg")
+	logger.WithField("user", "bob").Info("infomsg")
+
+	// The request ID is only known after the entries are stored.
+	_, logger = spotlog.Get(ctx)
+	logger.WithGlobalFields(logrus.Fields{"request_id": "abc", "user": "alice"})
+	logger.Error("errormsg")
+
+	assert.Equal(t, `level=debug msg=debugmsg request_id=abc route=/users user=alice
+level=info msg=infomsg request_id=abc route=/users user=bob
+level=error msg=errormsg request_id=abc route=/users user=alice
+`, stdout.String())
+	assert.Equal(t, logrus.Fields{"request_id": "abc", "route": "/users", "user": "alice"}, logger.GlobalFields())
+}
+
+func TestFlushDiscardClose(t *testing.T) {
+	var stdout bytes.Buffer
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+	)
+
+	logger.Debug("debugmsg1")
+	logger.Flush()
+	assert.Equal(t, "level=debug msg=debugmsg1\n", stdout.String())
+
+	stdout.Reset()
+	logger.Debug("debugmsg2")
+	logger.Discard()
+	logger.Flush()
+	assert.Empty(t, stdout.String())
+
+	logger.Debug("debugmsg3")
+	logger.Close(false)
+	logger.Debug("debugmsg4")
+	logger.Flush()
+	assert.Empty(t, stdout.String())
+
+	logger.Error("errormsg")
+	assert.Equal(t, "level=error msg=errormsg\n", stdout.String())
+}
+
+func finishScope(ctx context.Context, fail bool) (err error) {
+	defer spotlog.Finish(ctx, &err)
+
+	_, logger := spotlog.Get(ctx)
+	logger.Debug("debugmsg")
+	if fail {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func TestFinish(t *testing.T) {
+	var stdout bytes.Buffer
+	ctx := spotlog.Set(context.Background(), spotlog.New(spotlog.WithOutput(&stdout)))
+
+	assert.NoError(t, finishScope(ctx, false))
+	assert.Empty(t, stdout.String())
+
+	assert.Error(t, finishScope(ctx, true))
+	assert.Contains(t, stdout.String(), "debugmsg")
+}
+
+func TestForkFinish(t *testing.T) {
+	var stdout bytes.Buffer
+	root := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+	)
+	ctx := spotlog.Set(context.Background(), root)
+	root.Debug("parentmsg")
+
+	// A worker finishing without an error only discards its own entries.
+	forked, _ := spotlog.Fork(ctx)
+	assert.NoError(t, finishScope(forked, false))
+
+	// A closed child stores no entries, the rest of the tree is open.
+	_, child := spotlog.Fork(ctx)
+	child.Debug("closedmsg")
+	child.Close(false)
+	child.Debug("closedmsg")
+	root.Debug("openmsg")
+
+	root.Error("errormsg")
+	assert.Equal(t, `level=debug msg=parentmsg
+level=debug msg=openmsg
+level=error msg=errormsg
+`, stdout.String())
+}
+
+func TestFinishPanic(t *testing.T) {
+	var stdout bytes.Buffer
+	ctx := spotlog.Set(context.Background(), spotlog.New(spotlog.WithOutput(&stdout)))
+
+	assert.PanicsWithValue(t, "failed", func() {
+		defer spotlog.Finish(ctx, nil)
+
+		_, logger := spotlog.Get(ctx)
+		logger.Debug("debugmsg")
+		panic("failed")
+	})
+	assert.Contains(t, stdout.String(), "debugmsg")
+}
+
+func TestPassthroughWindow(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	var states []spotlog.State
+	var stdout bytes.Buffer
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+		spotlog.WithClock(func() time.Time { return now }),
+		spotlog.WithPassthroughWindow(2, time.Minute),
+		spotlog.WithStateCallback(func(s spotlog.State) {
+			states = append(states, s)
+		}),
+	)
+
+	logger.Error("errormsg1")
+	assert.Equal(t, spotlog.StatePassthrough, logger.State())
+	logger.Debug("cleanup1")
+	logger.Debug("cleanup2")
+	// The window closes at its last entry.
+	assert.Equal(t, spotlog.StateBuffering, logger.State())
+	assert.Len(t, states, 2)
+	logger.Debug("stored1")
+	assert.Equal(t, `level=error msg=errormsg1
+level=debug msg=cleanup1
+level=debug msg=cleanup2
+`, stdout.String())
+
+	// The window also closes after the duration.
+	stdout.Reset()
+	logger.Error("errormsg2")
+	logger.Debug("cleanup3")
+	now = now.Add(time.Minute)
+	assert.Equal(t, spotlog.StateBuffering, logger.State())
+	assert.Len(t, states, 4)
+	logger.Debug("stored2")
+	assert.Equal(t, `level=debug msg=stored1
+level=error msg=errormsg2
+level=debug msg=cleanup3
+`, stdout.String())
+
+	assert.Equal(t, []spotlog.State{
+		spotlog.StatePassthrough, spotlog.StateBuffering,
+		spotlog.StatePassthrough, spotlog.StateBuffering,
+	}, states)
+}
+
+func TestPanic(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(logger *spotlog.SpotLogger)
+	}{
+		{"SpotLogger.Panic", func(l *spotlog.SpotLogger) { l.Panic("panicmsg") }},
+		{"SpotLogger.Panicf", func(l *spotlog.SpotLogger) { l.Panicf("%s", "panicmsg") }},
+		{"SpotLogger.Panicln", func(l *spotlog.SpotLogger) { l.Panicln("panicmsg") }},
+		{"Entry.Panic", func(l *spotlog.SpotLogger) { l.WithField("k", "v").Panic("panicmsg") }},
+		{"Entry.Panicf", func(l *spotlog.SpotLogger) { l.WithField("k", "v").Panicf("%s", "panicmsg") }},
+		{"Entry.Panicln", func(l *spotlog.SpotLogger) { l.WithField("k", "v").Panicln("panicmsg") }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			logger := spotlog.New(
+				spotlog.WithOutput(&stdout),
+				// Panic flushes, even when the trigger stores everything.
+				spotlog.WithTrigger(spotlog.TriggerFunc(func(spotlog.Event) spotlog.Decision {
+					return spotlog.DecisionStore
+				})),
+			)
+			logger.Debug("debugmsg")
+
+			func() {
+				defer func() {
+					entry, ok := recover().(*logrus.Entry)
+					assert.True(t, ok)
+					assert.Equal(t, "panicmsg", entry.Message)
+					assert.Equal(t, logrus.PanicLevel, entry.Level)
+				}()
+				test.call(logger)
+			}()
+			assert.Contains(t, stdout.String(), "debugmsg")
+			assert.Contains(t, stdout.String(), "panicmsg")
+		})
+	}
+}
+
+func TestFatal(t *testing.T) {
+	var stdout bytes.Buffer
+	var code int
+	logger := spotlog.New(spotlog.WithOutput(&stdout))
+	logger.ExitFunc = func(c int) { code = c }
+
+	logger.Debug("debugmsg")
+	logger.WithField("k", "v").Fatalf("%s", "fatalmsg")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stdout.String(), "debugmsg")
+	assert.Contains(t, stdout.String(), "fatalmsg")
+}
+
+func TestRecoverAndFlush(t *testing.T) {
+	var stdout bytes.Buffer
+	ctx := spotlog.Set(context.Background(), spotlog.New(spotlog.WithOutput(&stdout)))
+
+	var recovered interface{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			recovered = recover()
+		}()
+		defer spotlog.RecoverAndFlush(ctx)
+
+		_, logger := spotlog.Get(ctx)
+		logger.Debug("debugmsg")
+		panic("failed")
+	}()
+	<-done
+
+	// The panic continues after the flush.
+	assert.Equal(t, "failed", recovered)
+	assert.Contains(t, stdout.String(), "debugmsg")
+	assert.Contains(t, stdout.String(), "recovered panic")
+	assert.Contains(t, stdout.String(), "panic=failed")
+}
+
+func TestHook(t *testing.T) {
+	var stdout bytes.Buffer
+	base := logrus.New()
+	base.Out = &stdout
+	base.Formatter = &logrus.TextFormatter{DisableTimestamp: true}
+	base.Level = logrus.InfoLevel
+	fired := &countHook{}
+	base.AddHook(fired)
+	spotlog.InstallHook(base)
+
+	ctx := spotlog.Set(context.Background(), spotlog.NewWithLogger(base))
+
+	base.WithContext(ctx).WithField("k", "v").Debug("debugmsg")
+	// Entries without a SpotLogger keep the original level.
+	base.Debug("plaindebugmsg")
+	base.Info("plainmsg")
+	assert.Equal(t, "level=info msg=plainmsg\n", stdout.String())
+	// Other hooks keep the original level too.
+	assert.Equal(t, 1, fired.count)
+
+	stdout.Reset()
+	base.WithContext(ctx).Error("errormsg")
+	assert.Equal(t, `level=debug msg=debugmsg k=v
+level=error msg=errormsg
+`, stdout.String())
+}
+
+// countHook counts the entries it is fired for.
+type countHook struct {
+	count int
+}
+
+func (h *countHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *countHook) Fire(*logrus.Entry) error {
+	h.count++
+	return nil
+}
+
+// libraryCall is a third-party function accepting a logrus.FieldLogger.
+func libraryCall(logger logrus.FieldLogger) {
+	logger.WithField("lib", "value").Debug("librarymsg")
+}
+
+func TestFieldLogger(t *testing.T) {
+	var stdout bytes.Buffer
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+	)
+
+	libraryCall(logger.FieldLogger())
+	logger.FieldLogger().Trace("tracemsg")
+	assert.Empty(t, stdout.String())
+
+	logger.FieldLogger().WithError(errors.New("failed")).Error("errormsg")
+	assert.Equal(t, `level=debug msg=librarymsg lib=value
+level=trace msg=tracemsg
+level=error msg=errormsg error=failed
+`, stdout.String())
+
+	assert.Panics(t, func() {
+		logger.FieldLogger().WithField("k", "v").Panic("panicmsg")
+	})
+	assert.Contains(t, stdout.String(), "panicmsg")
+}
+
+func TestChild(t *testing.T) {
+	var stdout bytes.Buffer
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+	)
+	logger.WithGlobalFields(logrus.Fields{"request_id": "abc"})
+
+	start := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	first := logger.Child(logrus.Fields{"worker": 1})
+	second := logger.Child(logrus.Fields{"worker": 2})
+
+	first.WithTime(start.Add(2 * time.Second)).Debug("first2")
+	second.WithTime(start.Add(1 * time.Second)).Debug("second1")
+	logger.WithTime(start).Debug("root0")
+	first.WithTime(start.Add(3 * time.Second)).Debug("first3")
+	assert.Empty(t, stdout.String())
+
+	second.WithTime(start.Add(4 * time.Second)).Error("second4")
+	assert.Equal(t, `level=debug msg=root0 request_id=abc
+level=debug msg=second1 request_id=abc worker=2
+level=debug msg=first2 request_id=abc worker=1
+level=debug msg=first3 request_id=abc worker=1
+level=error msg=second4 request_id=abc worker=2
+`, stdout.String())
+}
+
+func TestSameTimeOrder(t *testing.T) {
+	var stdout bytes.Buffer
+	start := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+		spotlog.WithShards(4),
+		spotlog.WithClock(func() time.Time { return start }),
+	)
+	child := logger.Child(logrus.Fields{"worker": 1})
+
+	// Entries with the same time are output in the order they were logged,
+	// whichever logger and shard stored them.
+	child.Debug("one")
+	logger.Debug("two")
+	child.Debug("three")
+	logger.Debug("four")
+	logger.Error("errormsg")
+	assert.Equal(t, `level=debug msg=one worker=1
+level=debug msg=two
+level=debug msg=three worker=1
+level=debug msg=four
+level=error msg=errormsg
+`, stdout.String())
+}
+
+func TestFork(t *testing.T) {
+	var stdout bytes.Buffer
+	ctx := spotlog.Set(context.Background(), spotlog.New(spotlog.WithOutput(&stdout)))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, logger := spotlog.Fork(ctx)
+			logger.Debug("workermsg")
+		}()
+	}
+	wg.Wait()
+	assert.Empty(t, stdout.String())
+
+	_, logger := spotlog.Fork(ctx)
+	logger.Error("errormsg")
+	assert.Equal(t, 4, strings.Count(stdout.String(), "workermsg"))
+	for i := 1; i <= 5; i++ {
+		assert.Contains(t, stdout.String(), fmt.Sprintf("fork=%d", i))
+	}
+}
+
+func TestTreeLimits(t *testing.T) {
+	var stdout bytes.Buffer
+	start := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+		spotlog.WithMaxEntries(2),
+	)
+
+	// The limit applies to the whole tree, the oldest entries of any
+	// logger are evicted.
+	children := make([]*spotlog.SpotLogger, 50)
+	for i := range children {
+		children[i] = logger.Child(logrus.Fields{"worker": i})
+		children[i].WithTime(start.Add(time.Duration(i) * time.Second)).Debug("workermsg")
+	}
+	logger.WithTime(start.Add(time.Minute)).Error("errormsg")
+	assert.Equal(t, `level=warning msg="spotlog: 48 earlier entries dropped"
+level=debug msg=workermsg worker=48
+level=debug msg=workermsg worker=49
+level=error msg=errormsg
+`, stdout.String())
+
+	// Children still store entries after their buffers were flushed.
+	stdout.Reset()
+	children[0].WithTime(start.Add(2 * time.Minute)).Debug("againmsg")
+	logger.WithTime(start.Add(3 * time.Minute)).Error("errormsg")
+	assert.Equal(t, `level=debug msg=againmsg worker=0
+level=error msg=errormsg
+`, stdout.String())
+}
+
+func TestMergedFlush(t *testing.T) {
+	var stdout bytes.Buffer
+	var ticks int64
+	start := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{TimestampFormat: time.RFC3339Nano}),
+		spotlog.WithClock(func() time.Time {
+			return start.Add(time.Duration(atomic.AddInt64(&ticks, 1)))
+		}),
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		child := logger.Child(logrus.Fields{"worker": i})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				child.WithField("n", n).Debug("workermsg")
+			}
+		}()
+	}
+	wg.Wait()
+	logger.Error("errormsg")
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	assert.Len(t, lines, 8*50+1)
+	var last time.Time
+	next := map[string]int{}
+	for _, line := range lines {
+		var ts, worker string
+		var n int
+		for _, field := range strings.Fields(line) {
+			kv := strings.SplitN(field, "=", 2)
+			switch kv[0] {
+			case "time":
+				ts = strings.Trim(kv[1], `"`)
+			case "worker":
+				worker = kv[1]
+			case "n":
+				n, _ = strconv.Atoi(kv[1])
+			}
+		}
+		parsed, err := time.Parse(time.RFC3339Nano, ts)
+		assert.NoError(t, err)
+		assert.False(t, parsed.Before(last), "out of order: %s", line)
+		last = parsed
+		if worker != "" {
+			// Entries of each child keep the order they were logged in.
+			assert.Equal(t, next[worker], n)
+			next[worker]++
+		}
+	}
+}
+
 func exampleHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, logger := spotlog.Get(r.Context())
 
@@ -0,0 +1,189 @@
+// Package spotlogmw provides net/http middleware which scopes one
+// spotlog.SpotLogger to each request.
+package spotlogmw
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/13rac1/spotlog"
+	"github.com/sirupsen/logrus"
+)
+
+// Option configures the middleware created by Handler.
+type Option func(*config)
+
+type config struct {
+	loggerOpts      []spotlog.Option
+	flushStatus     func(status int) bool
+	requestIDHeader string
+}
+
+// WithLoggerOptions sets the options used to create each request logger.
+func WithLoggerOptions(opts ...spotlog.Option) Option {
+	return func(c *config) {
+		c.loggerOpts = append(c.loggerOpts, opts...)
+	}
+}
+
+// WithFlushStatus sets the function deciding which response status codes
+// flush the stored entries. Defaults to 5xx status codes.
+func WithFlushStatus(flush func(status int) bool) Option {
+	return func(c *config) {
+		c.flushStatus = flush
+	}
+}
+
+// WithRequestIDHeader sets the request header containing the request ID.
+// Defaults to X-Request-ID. A random ID is generated when the header is empty.
+func WithRequestIDHeader(header string) Option {
+	return func(c *config) {
+		c.requestIDHeader = header
+	}
+}
+
+// Handler creates a SpotLogger for each request and stores it in the request
+// context. The stored entries are flushed when the response status is 5xx or
+// the handler panics, and discarded otherwise.
+func Handler(next http.Handler, opts ...Option) http.Handler {
+	c := &config{
+		flushStatus: func(status int) bool {
+			return status >= http.StatusInternalServerError
+		},
+		requestIDHeader: "X-Request-ID",
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := spotlog.New(c.loggerOpts...)
+
+		requestID := r.Header.Get(c.requestIDHeader)
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		logger.WithGlobalFields(logrus.Fields{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"remote_addr": r.RemoteAddr,
+			"request_id":  requestID,
+		})
+
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			p := recover()
+
+			status := sw.Status()
+			if p != nil && sw.status == 0 {
+				// net/http closes the connection without a response.
+				status = http.StatusInternalServerError
+			}
+			logger.WithGlobalFields(logrus.Fields{
+				"status": status,
+				"bytes":  sw.bytes,
+			})
+			logger.Close(p != nil || c.flushStatus(status))
+
+			if p != nil {
+				panic(p)
+			}
+		}()
+
+		next.ServeHTTP(sw, r.WithContext(spotlog.Set(r.Context(), logger)))
+	})
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// statusWriter captures the status code and bytes written of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+// WriteHeader captures the status code.
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write captures the bytes written.
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Flush implements http.Flusher when the wrapped ResponseWriter does.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker when the wrapped ResponseWriter does.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// Push implements http.Pusher when the wrapped ResponseWriter does.
+func (w *statusWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := w.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// ReadFrom implements io.ReaderFrom, so the wrapped ResponseWriter can send
+// files without copying them, and captures the bytes written.
+func (w *statusWriter) ReadFrom(r io.Reader) (int64, error) {
+	rf, ok := w.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(writerOnly{w}, r)
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := rf.ReadFrom(r)
+	w.bytes += int(n)
+	return n, err
+}
+
+// writerOnly hides the ReadFrom method of a writer from io.Copy.
+type writerOnly struct {
+	io.Writer
+}
+
+// Unwrap returns the wrapped ResponseWriter for http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Status returns the response status code, 200 OK if none was written.
+func (w *statusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
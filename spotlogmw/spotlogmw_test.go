@@ -0,0 +1,124 @@
+package spotlogmw_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/13rac1/spotlog"
+	"github.com/13rac1/spotlog/spotlogmw"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newHandler(stdout *bytes.Buffer, status int, opts ...spotlogmw.Option) http.Handler {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, logger := spotlog.Get(r.Context())
+		logger.Debug("debugmsg")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("body"))
+	})
+	opts = append(opts, spotlogmw.WithLoggerOptions(
+		spotlog.WithOutput(stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+	))
+	return spotlogmw.Handler(handler, opts...)
+}
+
+func TestHandlerDiscard(t *testing.T) {
+	var stdout bytes.Buffer
+	handler := newHandler(&stdout, http.StatusOK)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ok", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, stdout.String())
+}
+
+func TestHandlerFlush(t *testing.T) {
+	var stdout bytes.Buffer
+	handler := newHandler(&stdout, http.StatusBadGateway)
+
+	r := httptest.NewRequest(http.MethodPost, "/fail", nil)
+	r.Header.Set("X-Request-ID", "abc")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	assert.Equal(t, "level=debug msg=debugmsg bytes=4 method=POST path=/fail "+
+		"remote_addr=\"192.0.2.1:1234\" request_id=abc status=502\n", stdout.String())
+}
+
+func TestHandlerFlushStatus(t *testing.T) {
+	var stdout bytes.Buffer
+	handler := newHandler(&stdout, http.StatusNotFound, spotlogmw.WithFlushStatus(func(status int) bool {
+		return status >= http.StatusBadRequest
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/missing", nil))
+	assert.Contains(t, stdout.String(), "status=404")
+}
+
+func TestHandlerPanic(t *testing.T) {
+	var stdout bytes.Buffer
+	handler := spotlogmw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, logger := spotlog.Get(r.Context())
+		logger.Debug("debugmsg")
+		panic("failed")
+	}), spotlogmw.WithLoggerOptions(spotlog.WithOutput(&stdout)))
+
+	assert.PanicsWithValue(t, "failed", func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/panic", nil))
+	})
+	assert.Contains(t, stdout.String(), "debugmsg")
+	assert.Contains(t, stdout.String(), "status=500")
+}
+
+func TestHandlerHijack(t *testing.T) {
+	var stdout bytes.Buffer
+	handler := spotlogmw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, logger := spotlog.Get(r.Context())
+		logger.Debug("debugmsg")
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		_ = rw.Flush()
+	}), spotlogmw.WithLoggerOptions(spotlog.WithOutput(&stdout)))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "hijacked", string(body))
+
+	// Without a Hijacker the error of net/http is returned.
+	handler = spotlogmw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, err := w.(http.Hijacker).Hijack()
+		assert.Equal(t, http.ErrNotSupported, err)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestHandlerReadFrom(t *testing.T) {
+	var stdout bytes.Buffer
+	handler := spotlogmw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, logger := spotlog.Get(r.Context())
+		logger.Debug("debugmsg")
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.(io.ReaderFrom).ReadFrom(strings.NewReader("body"))
+	}), spotlogmw.WithLoggerOptions(spotlog.WithOutput(&stdout)))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "body", w.Body.String())
+	assert.Contains(t, stdout.String(), "bytes=4")
+}
@@ -0,0 +1,33 @@
+//go:build go1.21
+// +build go1.21
+
+package spotslog
+
+import (
+	"context"
+	"log/slog"
+)
+
+type contextKey string
+
+const loggerKey contextKey = "spotslogger"
+
+// Get returns the logger in the context or creates one using a Handler
+// writing to the handler of slog.Default().
+func Get(ctx context.Context) (context.Context, *slog.Logger) {
+	logger, ok := ctx.Value(loggerKey).(*slog.Logger)
+
+	if ok {
+		return ctx, logger
+	}
+
+	logger = slog.New(NewHandler(slog.Default().Handler()))
+	ctx = context.WithValue(ctx, loggerKey, logger)
+
+	return ctx, logger
+}
+
+// Set the logger in the context.
+func Set(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
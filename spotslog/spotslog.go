@@ -0,0 +1,165 @@
+//go:build go1.21
+// +build go1.21
+
+// Package spotslog provides a log/slog Handler with the storage behaviour of
+// spotlog: records are stored until a record at the trigger level is handled,
+// then all stored records are written to the inner Handler.
+package spotslog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Option configures a Handler created by NewHandler.
+type Option func(*config)
+
+type config struct {
+	triggerLevel slog.Level
+	maxEntries   int
+}
+
+// WithTriggerLevel sets the minimum level which writes the stored records.
+// Defaults to slog.LevelError.
+func WithTriggerLevel(level slog.Level) Option {
+	return func(c *config) {
+		c.triggerLevel = level
+	}
+}
+
+// WithMaxEntries limits the count of stored records. The oldest records are
+// dropped when the limit is reached. Defaults to zero, which is unlimited.
+func WithMaxEntries(n int) Option {
+	return func(c *config) {
+		c.maxEntries = n
+	}
+}
+
+// storedRecord is a record with the Handler and context it was handled by.
+type storedRecord struct {
+	// inner has the attrs and groups of the Handler the record was handled
+	// by, so they are kept on replay.
+	inner  slog.Handler
+	ctx    context.Context
+	record slog.Record
+}
+
+// store is the record storage shared by a Handler and the Handlers derived
+// from it with WithAttrs and WithGroup.
+type store struct {
+	config
+	// root is the inner Handler without attrs or groups.
+	root slog.Handler
+
+	mu      sync.Mutex
+	records []storedRecord
+	dropped int
+}
+
+// Handler is a slog.Handler which stores records until a record at the
+// trigger level is handled.
+type Handler struct {
+	inner slog.Handler
+	store *store
+}
+
+// NewHandler creates a Handler writing to inner.
+func NewHandler(inner slog.Handler, opts ...Option) *Handler {
+	s := &store{
+		config: config{triggerLevel: slog.LevelError},
+		root:   inner,
+	}
+	for _, opt := range opts {
+		opt(&s.config)
+	}
+	return &Handler{inner: inner, store: s}
+}
+
+// Enabled returns true for all levels, because every record is stored.
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+// Handle stores the record or, if the record is at the trigger level, writes
+// the stored records followed by the record.
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	s := h.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Level < s.triggerLevel {
+		s.push(storedRecord{inner: h.inner, ctx: ctx, record: r.Clone()})
+		return nil
+	}
+
+	err := s.flush()
+	if handleErr := h.inner.Handle(ctx, r); err == nil {
+		err = handleErr
+	}
+	return err
+}
+
+// WithAttrs returns a Handler sharing the stored records, with attrs added to
+// every record.
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &Handler{inner: h.inner.WithAttrs(attrs), store: h.store}
+}
+
+// WithGroup returns a Handler sharing the stored records, with the following
+// attrs qualified by the group name.
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{inner: h.inner.WithGroup(name), store: h.store}
+}
+
+// Flush writes the stored records and clears them.
+func (h *Handler) Flush() error {
+	h.store.mu.Lock()
+	defer h.store.mu.Unlock()
+
+	return h.store.flush()
+}
+
+// Discard clears the stored records without writing them.
+func (h *Handler) Discard() {
+	h.store.mu.Lock()
+	defer h.store.mu.Unlock()
+
+	h.store.records = nil
+	h.store.dropped = 0
+}
+
+// push adds a record, dropping the oldest record if the store is full. Must
+// be called with mu held.
+func (s *store) push(r storedRecord) {
+	if s.maxEntries > 0 && len(s.records) >= s.maxEntries {
+		s.records[0] = storedRecord{}
+		s.records = s.records[1:]
+		s.dropped++
+	}
+	s.records = append(s.records, r)
+}
+
+// flush writes the stored records and clears them. Returns the first error
+// of the inner Handlers. Must be called with mu held.
+func (s *store) flush() error {
+	var err error
+	if s.dropped > 0 {
+		t := time.Now()
+		if len(s.records) > 0 {
+			t = s.records[0].record.Time
+		}
+		r := slog.NewRecord(t, slog.LevelWarn, fmt.Sprintf("spotlog: %d earlier entries dropped", s.dropped), 0)
+		err = s.root.Handle(context.Background(), r)
+	}
+	for _, stored := range s.records {
+		if handleErr := stored.inner.Handle(stored.ctx, stored.record); err == nil {
+			err = handleErr
+		}
+	}
+	s.records = nil
+	s.dropped = 0
+	return err
+}
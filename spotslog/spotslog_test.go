@@ -0,0 +1,80 @@
+//go:build go1.21
+// +build go1.21
+
+package spotslog_test
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/13rac1/spotlog/spotslog"
+	"github.com/stretchr/testify/assert"
+)
+
+// newInner returns a text handler without timestamps for reproducible output.
+func newInner(stdout *bytes.Buffer) slog.Handler {
+	return slog.NewTextHandler(stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+}
+
+func TestHandler(t *testing.T) {
+	var stdout bytes.Buffer
+	logger := slog.New(spotslog.NewHandler(newInner(&stdout)))
+
+	logger.Debug("debugmsg")
+	logger.With("request_id", "abc").WithGroup("user").Info("infomsg", "id", 1)
+	assert.Empty(t, stdout.String())
+
+	logger.Error("errormsg")
+	assert.Equal(t, `level=DEBUG msg=debugmsg
+level=INFO msg=infomsg request_id=abc user.id=1
+level=ERROR msg=errormsg
+`, stdout.String())
+}
+
+func TestHandlerOptions(t *testing.T) {
+	var stdout bytes.Buffer
+	handler := spotslog.NewHandler(newInner(&stdout),
+		spotslog.WithTriggerLevel(slog.LevelWarn),
+		spotslog.WithMaxEntries(1),
+	)
+	logger := slog.New(handler)
+
+	logger.Debug("debugmsg1")
+	logger.Debug("debugmsg2")
+	logger.Warn("warnmsg")
+	assert.Equal(t, `level=WARN msg="spotlog: 1 earlier entries dropped"
+level=DEBUG msg=debugmsg2
+level=WARN msg=warnmsg
+`, stdout.String())
+
+	stdout.Reset()
+	logger.Debug("debugmsg3")
+	handler.Discard()
+	assert.NoError(t, handler.Flush())
+	assert.Empty(t, stdout.String())
+}
+
+func TestContext(t *testing.T) {
+	var stdout bytes.Buffer
+	ctx := spotslog.Set(context.Background(),
+		slog.New(spotslog.NewHandler(newInner(&stdout))).With("request_id", "abc"))
+
+	_, logger := spotslog.Get(ctx)
+	logger.Debug("debugmsg")
+	_, logger = spotslog.Get(ctx)
+	logger.Error("errormsg")
+
+	assert.Equal(t, `level=DEBUG msg=debugmsg request_id=abc
+level=ERROR msg=errormsg request_id=abc
+`, stdout.String())
+}
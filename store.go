@@ -0,0 +1,436 @@
+package spotlog
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// store is the entry storage shared by a SpotLogger and its children. Each
+// logger of the tree stores into its own buffer, the buffers are merged in
+// timestamp order by a flush.
+//
+// Entries are stored holding only the lock of a shard, so concurrent log
+// calls don't contend on mu. Everything else holds mu, and a flush or discard
+// also locks all buffers.
+//
+// The entry and byte limits apply to the whole tree. When a limit is reached,
+// the oldest entry of all buffers is evicted.
+type store struct {
+	mu     sync.Mutex
+	config *config
+	// shards is the shard count of the root buffer.
+	shards int
+	// buffers are the buffers holding entries, the root buffer first.
+	// Changed with mu held, read without mu from attached.
+	buffers  []*buffer
+	attached atomic.Value
+
+	// count is the count of stored entries, only kept if the store has an
+	// entry or byte limit. Changed with the lock of a shard held. Accessed
+	// atomically.
+	count int64
+	// seq is the sequence number of the last stored entry, so entries of
+	// different buffers with the same time are output in the order they were
+	// stored. Accessed atomically.
+	seq uint64
+
+	// window passes entries through after a trigger.
+	window window
+	// closed stops storing entries, see Close.
+	closed bool
+	// mode is storing, passthrough or closed, following window and closed.
+	// Changed with mu held, and with the buffers locked when entries stop
+	// being stored. Accessed atomically.
+	mode int32
+
+	// forks is the count of loggers created by Fork.
+	forks int
+
+	// usage releases the resources of the store when it is garbage
+	// collected.
+	usage *usage
+}
+
+// Modes of a store.
+const (
+	modeStoring int32 = iota
+	modePassthrough
+	modeClosed
+)
+
+func newStore(c *config) *store {
+	shards := c.shards
+	// Repeats are collapsed against the newest entry, which is only known
+	// with a single shard.
+	if shards <= 0 || c.aggregate {
+		shards = 1
+	}
+	if c.spillDir != "" {
+		cleanSpillDir(c.spillDir)
+	}
+	s := &store{
+		config: c,
+		shards: shards,
+		window: window{
+			entries:  c.windowEntries,
+			duration: c.windowDuration,
+		},
+		usage: newUsage(acquireOutputLock(c.base)),
+	}
+	return s
+}
+
+// newBuffer adds a buffer for a logger of the tree. The root logger is
+// shared by many goroutines and uses the configured shards, a child is
+// usually used by one goroutine and uses a single shard.
+func (s *store) newBuffer() *buffer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shards := 1
+	if len(s.buffers) == 0 {
+		shards = s.shards
+	}
+	b := newBuffer(s, shards)
+	s.setBuffers(append(s.buffers, b))
+	return b
+}
+
+// setBuffers replaces the buffers. Must be called with mu held.
+func (s *store) setBuffers(buffers []*buffer) {
+	s.buffers = buffers
+	// The slice is copied, so later changes don't race with readers.
+	s.attached.Store(append([]*buffer(nil), buffers...))
+}
+
+// attach adds a buffer removed by reset back to the store.
+func (s *store) attach(b *buffer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !b.detached {
+		return
+	}
+	b.lock()
+	b.detached = false
+	b.unlock()
+	s.setBuffers(append(s.buffers, b))
+}
+
+// limited returns true if the store has an entry or byte limit, which needs
+// the count of entries.
+func (s *store) limited() bool {
+	return s.config.maxEntries > 0 || s.config.maxBytes > 0
+}
+
+// overLimit returns true if the store is over its entry or byte limit.
+func (s *store) overLimit() bool {
+	c := s.config
+	return c.maxEntries > 0 && atomic.LoadInt64(&s.count) > int64(c.maxEntries) ||
+		// An entry larger than maxBytes is kept if it is the only one.
+		c.maxBytes > 0 && atomic.LoadInt64(&s.usage.bytes) > int64(c.maxBytes) && atomic.LoadInt64(&s.count) > 1
+}
+
+// limitsBytes returns true if the store has a byte limit.
+func (s *store) limitsBytes() bool {
+	return s.config.maxBytes > 0 || atomic.LoadInt64(&globalBudget.max) > 0
+}
+
+// evict evicts the oldest entries of all buffers until the store and the
+// global budget are within their limits. The entry with the sequence number
+// keep is only evicted for the limits of the store, so a logger storing an
+// entry is not emptied while other loggers use up the global budget.
+func (s *store) evict(keep uint64) {
+	for {
+		if s.overLimit() {
+			keep = 0
+		} else if !globalBudget.exceeded() {
+			return
+		}
+		if !s.evictOldest(keep) {
+			return
+		}
+	}
+}
+
+// evictOldest evicts the oldest entry of all buffers, or the oldest segment
+// of spilled entries if it is older. Returns false if the store is empty, or
+// the oldest entry has the sequence number keep.
+func (s *store) evictOldest(keep uint64) bool {
+	for {
+		var oldest *buffer
+		var sh *shard
+		var seq uint64
+		var t time.Time
+		for _, b := range s.attached.Load().([]*buffer) {
+			if b.spill != nil {
+				// Spilled entries are older than the entries in memory.
+				if st, ok := b.spill.oldest(); ok && (oldest == nil || st.Before(t)) {
+					oldest, sh, t = b, nil, st
+				}
+			}
+			bsh, bseq, bt := b.oldest()
+			if bsh != nil && (oldest == nil || bt.Before(t)) {
+				oldest, sh, seq, t = b, bsh, bseq, bt
+			}
+		}
+		if oldest == nil {
+			return false
+		}
+		if sh == nil {
+			return oldest.spill.evictOldest()
+		}
+		if seq == keep {
+			return false
+		}
+
+		sh.mu.Lock()
+		// The entry may have been removed by another goroutine, then the
+		// buffers are searched again.
+		found := sh.count > 0 && sh.ring[sh.start].seq == seq
+		if found {
+			oldest.evict(sh)
+		}
+		sh.mu.Unlock()
+		if found {
+			return true
+		}
+	}
+}
+
+// lockBuffers stops entries from being stored in all buffers. Must be called
+// with mu held.
+func (s *store) lockBuffers() {
+	for _, b := range s.buffers {
+		b.lock()
+	}
+}
+
+// unlockBuffers unlocks the buffers, and removes the buffers detached by reset.
+func (s *store) unlockBuffers() {
+	for _, b := range s.buffers {
+		b.unlock()
+	}
+	s.removeDetached()
+}
+
+// removeDetached removes the detached buffers. Must be called with mu held.
+func (s *store) removeDetached() {
+	detached := false
+	for _, b := range s.buffers {
+		detached = detached || b.detached
+	}
+	if !detached {
+		return
+	}
+	var attached []*buffer
+	for _, b := range s.buffers {
+		if !b.detached {
+			attached = append(attached, b)
+		}
+	}
+	s.setBuffers(attached)
+}
+
+// setMode updates mode after a change of window or closed. Must be called with
+// mu held, and with the buffers locked if entries stop being stored.
+func (s *store) setMode() {
+	mode := modeStoring
+	if s.window.state == StatePassthrough {
+		mode = modePassthrough
+	} else if s.closed {
+		mode = modeClosed
+	}
+	atomic.StoreInt32(&s.mode, mode)
+}
+
+// open starts the window at now. Returns true if the state changed. Must be
+// called with mu held and the buffers locked.
+func (s *store) open(now time.Time) bool {
+	changed := s.window.open(now)
+	s.setMode()
+	return changed
+}
+
+// take uses one entry of the window at now, see window.take. Must be called
+// with mu held.
+func (s *store) take(now time.Time) (pass bool, changed bool) {
+	pass, changed = s.window.take(now)
+	if changed {
+		s.setMode()
+	}
+	return pass, changed
+}
+
+// expireWindow closes the window if its duration has passed at now. Returns
+// true if the state changed. Must be called with mu held.
+func (s *store) expireWindow(now time.Time) bool {
+	changed := s.window.expire(now)
+	if changed {
+		s.setMode()
+	}
+	return changed
+}
+
+// close stops storing entries. Must be called with mu held and the buffers
+// locked.
+func (s *store) close() {
+	s.closed = true
+	s.setMode()
+}
+
+// expire evicts the entries older than the maximum age from all buffers. Must
+// be called with mu held.
+func (s *store) expire(now time.Time) {
+	for _, b := range s.buffers {
+		b.expire(now)
+	}
+}
+
+// reset removes the entries of all buffers. The buffers of the children are
+// detached and removed by unlockBuffers, so the store does not grow with every
+// child ever created. A child logging again attaches its buffer. Must be
+// called with mu held and the buffers locked.
+func (s *store) reset() {
+	for i, b := range s.buffers {
+		b.reset()
+		b.detached = i > 0
+	}
+	atomic.StoreInt64(&s.count, 0)
+	s.usage.reset()
+}
+
+// discard removes the entries of the buffer of a child and detaches it,
+// leaving the other buffers of the store as they are. The buffer stores no
+// further entries if close is true. Must be called with mu held.
+func (s *store) discard(b *buffer, close bool) {
+	b.lock()
+	count, bytes := b.reset()
+	b.detached = true
+	b.closed = b.closed || close
+	b.unlock()
+
+	if s.limited() {
+		atomic.AddInt64(&s.count, -int64(count))
+	}
+	s.usage.add(-bytes)
+	s.removeDetached()
+}
+
+// drops is the total of the dropped counts of all buffers.
+type drops struct {
+	entries int
+	bytes   int
+	fields  int
+	// limitsBytes is true if the store has a byte limit.
+	limitsBytes bool
+	// oldest is the time of the oldest stored entry, zero if none.
+	oldest time.Time
+}
+
+// drops returns the total of the dropped counts. Must be called with mu held
+// and the buffers locked.
+func (s *store) drops() drops {
+	d := drops{limitsBytes: s.limitsBytes()}
+	for _, b := range s.buffers {
+		b.addDrops(&d)
+	}
+	return d
+}
+
+// each calls fn for the entries of all buffers. A single buffer is in the
+// order the entries were stored, multiple buffers are merged in timestamp
+// order. Entries with the same timestamp are output in the order they were
+// stored. Must be called with mu held and the buffers locked.
+func (s *store) each(fn func(storedEntry)) {
+	if len(s.buffers) == 1 {
+		c := s.buffers[0].cursor(false)
+		for c.next() {
+			fn(c.head)
+		}
+		return
+	}
+
+	h := make(mergeHeap, 0, len(s.buffers))
+	for _, b := range s.buffers {
+		// Entries with a time set by WithTime may be out of order.
+		c := b.cursor(true)
+		if c.next() {
+			h = append(h, c)
+		}
+	}
+
+	heap.Init(&h)
+	for h.Len() > 0 {
+		fn(h[0].head)
+		if h[0].next() {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+}
+
+// cursor reads the entries of a buffer in order, the spilled entries first.
+type cursor struct {
+	spilled *spillReader
+	entries []storedEntry
+	// head is the current entry, set by next.
+	head storedEntry
+}
+
+// cursor returns a cursor of the entries of the buffer. The entries in memory
+// are sorted by time if byTime is true. Must be called with the buffer locked.
+func (b *buffer) cursor(byTime bool) *cursor {
+	entries := b.entries()
+	if byTime {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].before(&entries[j])
+		})
+	}
+	c := &cursor{entries: entries}
+	if b.spill != nil {
+		c.spilled = b.spill.reader()
+	}
+	return c
+}
+
+// next moves to the next entry. Returns false if there are no more entries.
+func (c *cursor) next() bool {
+	if c.spilled != nil {
+		if entry, ok := c.spilled.next(); ok {
+			c.head = entry
+			return true
+		}
+		c.spilled = nil
+	}
+	if len(c.entries) == 0 {
+		return false
+	}
+	c.head = c.entries[0]
+	c.entries = c.entries[1:]
+	return true
+}
+
+// before orders cursors by their current entry.
+func (c *cursor) before(other *cursor) bool {
+	return c.head.before(&other.head)
+}
+
+// mergeHeap is a min-heap of cursors, ordered by their current entry.
+type mergeHeap []*cursor
+
+func (h mergeHeap) Len() int            { return len(h) }
+func (h mergeHeap) Less(i, j int) bool  { return h[i].before(h[j]) }
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*cursor)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
@@ -0,0 +1,168 @@
+package spotlog
+
+import (
+	"context"
+	"errors"
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Decision is the action taken for an incoming log entry.
+type Decision int
+
+const (
+	// DecisionStore stores the entry until the next flush.
+	DecisionStore Decision = iota
+	// DecisionPrint prints the entry without printing the stored entries. The
+	// entry is also stored, so it is printed in order by a later flush.
+	DecisionPrint
+	// DecisionFlush prints the stored entries followed by the entry.
+	DecisionFlush
+)
+
+// Event describes an incoming log entry passed to a Trigger.
+type Event struct {
+	Level   logrus.Level
+	Data    logrus.Fields
+	Context context.Context
+
+	// stored is copied, so the entry does not escape to the heap when the
+	// trigger is called.
+	stored storedEntry
+}
+
+// Message renders the message of the entry.
+func (e Event) Message() string {
+	return e.stored.message()
+}
+
+// Trigger decides the action taken for each incoming log entry.
+type Trigger interface {
+	Decide(e Event) Decision
+}
+
+// TriggerFunc is an adapter to allow the use of ordinary functions as a
+// Trigger.
+type TriggerFunc func(e Event) Decision
+
+// Decide calls f(e).
+func (f TriggerFunc) Decide(e Event) Decision {
+	return f(e)
+}
+
+// LevelTrigger flushes for entries at level or higher priority.
+func LevelTrigger(level logrus.Level) Trigger {
+	return TriggerFunc(func(e Event) Decision {
+		// Levels have lower values the higher their priority is.
+		if e.Level <= level {
+			return DecisionFlush
+		}
+		return DecisionStore
+	})
+}
+
+// FieldTrigger flushes for entries with the field key when match returns true
+// for the field value.
+func FieldTrigger(key string, match func(value interface{}) bool) Trigger {
+	return TriggerFunc(func(e Event) Decision {
+		value, ok := e.Data[key]
+		if ok && match(value) {
+			return DecisionFlush
+		}
+		return DecisionStore
+	})
+}
+
+// FieldAtLeast flushes for entries with a numeric field key greater than or
+// equal to min, for example FieldAtLeast("status", 500).
+func FieldAtLeast(key string, min float64) Trigger {
+	return FieldTrigger(key, func(value interface{}) bool {
+		n, ok := toFloat(value)
+		return ok && n >= min
+	})
+}
+
+// toFloat converts a numeric value to float64.
+func toFloat(value interface{}) (float64, bool) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+// ErrorIsTrigger flushes for entries with an error field, added by WithError,
+// matching target using errors.Is.
+func ErrorIsTrigger(target error) Trigger {
+	return TriggerFunc(func(e Event) Decision {
+		err, ok := e.Data[logrus.ErrorKey].(error)
+		if ok && errors.Is(err, target) {
+			return DecisionFlush
+		}
+		return DecisionStore
+	})
+}
+
+// ErrorAsTrigger flushes for entries with an error field, added by WithError,
+// matching the type target points to using errors.As. Panics if target is not
+// a non-nil pointer.
+func ErrorAsTrigger(target interface{}) Trigger {
+	targetType := reflect.TypeOf(target)
+	if targetType == nil || targetType.Kind() != reflect.Ptr {
+		panic("spotlog: target must be a non-nil pointer")
+	}
+	return TriggerFunc(func(e Event) Decision {
+		err, ok := e.Data[logrus.ErrorKey].(error)
+		// A new target is used for each call so Decide is goroutine safe.
+		if ok && errors.As(err, reflect.New(targetType.Elem()).Interface()) {
+			return DecisionFlush
+		}
+		return DecisionStore
+	})
+}
+
+// AnyOf returns the strongest decision of the triggers.
+func AnyOf(triggers ...Trigger) Trigger {
+	return TriggerFunc(func(e Event) Decision {
+		decision := DecisionStore
+		for _, t := range triggers {
+			if d := t.Decide(e); d > decision {
+				decision = d
+			}
+		}
+		return decision
+	})
+}
+
+// AllOf returns the weakest decision of the triggers, so an entry is only
+// printed if every trigger prints it.
+func AllOf(triggers ...Trigger) Trigger {
+	return TriggerFunc(func(e Event) Decision {
+		if len(triggers) == 0 {
+			return DecisionStore
+		}
+		decision := DecisionFlush
+		for _, t := range triggers {
+			if d := t.Decide(e); d < decision {
+				decision = d
+			}
+		}
+		return decision
+	})
+}
+
+// Not flushes for entries stored by the trigger, and stores all others.
+func Not(t Trigger) Trigger {
+	return TriggerFunc(func(e Event) Decision {
+		if t.Decide(e) == DecisionStore {
+			return DecisionFlush
+		}
+		return DecisionStore
+	})
+}
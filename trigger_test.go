@@ -0,0 +1,115 @@
+package spotlog_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/13rac1/spotlog"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+var errNotFound = errors.New("not found")
+
+func newTriggerLogger(t spotlog.Trigger) (*bytes.Buffer, *spotlog.SpotLogger) {
+	var stdout bytes.Buffer
+	logger := spotlog.New(
+		spotlog.WithOutput(&stdout),
+		spotlog.WithFormatter(&logrus.TextFormatter{DisableTimestamp: true}),
+		spotlog.WithTrigger(t),
+	)
+	return &stdout, logger
+}
+
+func TestFieldAtLeast(t *testing.T) {
+	stdout, logger := newTriggerLogger(spotlog.FieldAtLeast("status", 500))
+
+	logger.Debug("debugmsg")
+	logger.WithField("status", 404).Info("notfound")
+	logger.Error("errormsg")
+	assert.Empty(t, stdout.String())
+
+	logger.WithField("status", 503).Info("unavailable")
+	assert.Contains(t, stdout.String(), "debugmsg")
+	assert.Contains(t, stdout.String(), "notfound")
+	assert.Contains(t, stdout.String(), "errormsg")
+	assert.Contains(t, stdout.String(), "unavailable")
+}
+
+func TestErrorIsTrigger(t *testing.T) {
+	stdout, logger := newTriggerLogger(spotlog.ErrorIsTrigger(errNotFound))
+
+	logger.WithError(errors.New("other")).Error("othermsg")
+	assert.Empty(t, stdout.String())
+
+	logger.WithError(fmt.Errorf("wrapped: %w", errNotFound)).Warn("notfoundmsg")
+	assert.Contains(t, stdout.String(), "othermsg")
+	assert.Contains(t, stdout.String(), "notfoundmsg")
+}
+
+func TestErrorAsTrigger(t *testing.T) {
+	var pathErr *os.PathError
+	stdout, logger := newTriggerLogger(spotlog.ErrorAsTrigger(&pathErr))
+
+	logger.WithError(errNotFound).Error("othermsg")
+	assert.Empty(t, stdout.String())
+
+	_, err := os.Open("/does/not/exist")
+	logger.WithError(err).Warn("patherrmsg")
+	assert.Contains(t, stdout.String(), "othermsg")
+	assert.Contains(t, stdout.String(), "patherrmsg")
+}
+
+func TestTriggerCombinators(t *testing.T) {
+	status := spotlog.FieldAtLeast("status", 500)
+	errorLevel := spotlog.LevelTrigger(logrus.ErrorLevel)
+	printAll := spotlog.TriggerFunc(func(e spotlog.Event) spotlog.Decision {
+		return spotlog.DecisionPrint
+	})
+
+	tests := []struct {
+		name     string
+		trigger  spotlog.Trigger
+		status   int
+		level    logrus.Level
+		expected spotlog.Decision
+	}{
+		{"AnyOf none", spotlog.AnyOf(status, errorLevel), 200, logrus.InfoLevel, spotlog.DecisionStore},
+		{"AnyOf one", spotlog.AnyOf(status, errorLevel), 200, logrus.ErrorLevel, spotlog.DecisionFlush},
+		{"AnyOf print", spotlog.AnyOf(status, printAll), 200, logrus.InfoLevel, spotlog.DecisionPrint},
+		{"AllOf one", spotlog.AllOf(status, errorLevel), 500, logrus.InfoLevel, spotlog.DecisionStore},
+		{"AllOf all", spotlog.AllOf(status, errorLevel), 500, logrus.ErrorLevel, spotlog.DecisionFlush},
+		{"AllOf print", spotlog.AllOf(status, printAll), 500, logrus.InfoLevel, spotlog.DecisionPrint},
+		{"Not store", spotlog.Not(status), 500, logrus.InfoLevel, spotlog.DecisionStore},
+		{"Not flush", spotlog.Not(status), 200, logrus.InfoLevel, spotlog.DecisionFlush},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := spotlog.Event{
+				Level: test.level,
+				Data:  logrus.Fields{"status": test.status},
+			}
+			assert.Equal(t, test.expected, test.trigger.Decide(e))
+		})
+	}
+}
+
+func TestTriggerPrint(t *testing.T) {
+	stdout, logger := newTriggerLogger(spotlog.TriggerFunc(func(e spotlog.Event) spotlog.Decision {
+		if e.Message() == "auditmsg" {
+			return spotlog.DecisionPrint
+		}
+		return spotlog.LevelTrigger(logrus.ErrorLevel).Decide(e)
+	}))
+
+	logger.Debug("debugmsg")
+	logger.Info("auditmsg")
+	assert.Equal(t, "level=info msg=auditmsg\n", stdout.String())
+
+	logger.Error("errormsg")
+	assert.Contains(t, stdout.String(), "debugmsg")
+	assert.Contains(t, stdout.String(), "errormsg")
+}
@@ -0,0 +1,82 @@
+package spotlog
+
+import (
+	"time"
+)
+
+// State is the storage state of a SpotLogger.
+type State int
+
+const (
+	// StateBuffering stores entries until a trigger.
+	StateBuffering State = iota
+	// StatePassthrough prints entries immediately after a trigger, see
+	// WithPassthroughWindow.
+	StatePassthrough
+)
+
+func (s State) String() string {
+	switch s {
+	case StateBuffering:
+		return "buffering"
+	case StatePassthrough:
+		return "passthrough"
+	}
+	return "unknown"
+}
+
+// window keeps a logger in pass-through after a trigger.
+type window struct {
+	// entries and duration limit the window, zero is no limit.
+	entries  int
+	duration time.Duration
+
+	state State
+	left  int
+	until time.Time
+}
+
+// enabled returns true if the window is configured.
+func (w *window) enabled() bool {
+	return w.entries > 0 || w.duration > 0
+}
+
+// open starts the window at now. Returns true if the state changed.
+func (w *window) open(now time.Time) bool {
+	if !w.enabled() {
+		return false
+	}
+	changed := w.state != StatePassthrough
+	w.state = StatePassthrough
+	w.left = w.entries
+	w.until = now.Add(w.duration)
+	return changed
+}
+
+// take uses one entry of the window at now. Returns true if the entry passes
+// through, and true if the state changed because the window closed. The
+// window closes at its last entry, or at the first entry after its duration.
+func (w *window) take(now time.Time) (pass bool, changed bool) {
+	if w.state != StatePassthrough {
+		return false, false
+	}
+	if w.expire(now) {
+		return false, true
+	}
+	w.left--
+	if w.entries > 0 && w.left <= 0 {
+		w.state = StateBuffering
+		return true, true
+	}
+	return true, false
+}
+
+// expire closes the window if its duration has passed at now. Returns true if
+// the state changed.
+func (w *window) expire(now time.Time) bool {
+	if w.state != StatePassthrough || w.duration <= 0 || now.Before(w.until) {
+		return false
+	}
+	w.state = StateBuffering
+	return true
+}